@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// currentTOTPCodeMatches is true when the user hasn't enrolled yet, or
+// when code is valid for their current secret. Changing or removing an
+// enrolled secret requires proving possession of it.
+func currentTOTPCodeMatches(user, code string) (bool, error) {
+	secret, err := gDB.GetTOTPSecret(user)
+	if err != nil {
+		return false, err
+	}
+
+	return secret == "" || validateTOTP(secret, code, time.Now()), nil
+}
+
+func enrollTOTP(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+
+	confirmation := ConfirmationRequest{}
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(&confirmation); err != nil {
+			writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse request")
+			return
+		}
+	}
+
+	matches, err := currentTOTPCodeMatches(user, confirmation.Code)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to enroll")
+		return
+	}
+
+	if !matches {
+		writeError(request, response, http.StatusForbidden, ErrInvalidCode, "Invalid code")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err == nil {
+		err = gDB.SetTOTPSecret(user, secret)
+	}
+
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to enroll")
+		return
+	}
+
+	audit(request, 0, AuditTOTPEnroll, "", nil, "ok")
+	response.WriteEntity(TOTPEnrollment{secret, totpURI(secret, user)})
+}
+
+func removeTOTP(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+
+	matches, err := currentTOTPCodeMatches(user, request.QueryParameter("code"))
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to remove TOTP secret")
+		return
+	}
+
+	if !matches {
+		writeError(request, response, http.StatusForbidden, ErrInvalidCode, "Invalid code")
+		return
+	}
+
+	if err = gDB.DeleteTOTPSecret(user); err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to remove TOTP secret")
+		return
+	}
+
+	audit(request, 0, AuditTOTPRemove, "", nil, "ok")
+}
+
+func deleteLocations(request *restful.Request, response *restful.Response) {
+	if err := gDB.DeleteLocationsForUser(gPersona.GetLoginName(request.Request)); err != nil {
+		audit(request, 0, AuditLocationsDelete, "", nil, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to delete locations")
+		return
+	}
+
+	audit(request, 0, AuditLocationsDelete, "", nil, "ok")
+}
+
+// DeleteAccount removes everything kept about the user, returning the
+// number of devices deleted. The audit log is append-only, so the user's
+// entries are kept, but without their login name, source address and
+// arguments.
+func (self DB) DeleteAccount(user string) (int64, error) {
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var devices int64
+	if err = tx.QueryRow(`select count(*) from devices where user=?`, user).Scan(&devices); err != nil {
+		return 0, err
+	}
+
+	for _, statement := range []string{
+		`delete from locations where device_id in (select id from devices where user=?)`,
+		`delete from commands_for_device where device_id in (select id from devices where user=?)`,
+		`delete from invocations where device_id in (select id from devices where user=?)`,
+		`delete from devices where user=?`,
+		`delete from sessions where user=?`,
+		`delete from totp_secrets where user=?`,
+		`delete from exports where user=?`,
+		`delete from geocode_cache where user=?`,
+		`update audit_log set actor="", source_ip="", arguments="" where actor=?`,
+	} {
+		if _, err = tx.Exec(statement, user); err != nil {
+			return 0, err
+		}
+	}
+
+	return devices, tx.Commit()
+}
+
+// requestAccountDeletion only starts a confirmation, like destructive
+// commands: nothing is deleted until it is confirmed.
+func requestAccountDeletion(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+
+	secret, err := gDB.GetTOTPSecret(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to request confirmation")
+		return
+	}
+
+	pending, err := newConfirmation(user, 0, AuditAccountDelete, CommandContext{})
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to request confirmation")
+		return
+	}
+
+	audit(request, 0, AuditAccountDelete, "", nil, "confirmation pending")
+
+	response.WriteHeaderAndEntity(http.StatusAccepted, ConfirmationResponse{
+		Id:           pending.Id,
+		Confirm:      apiRoot(request) + "/account/confirm/" + pending.Id,
+		Expires:      pending.Expires.Unix(),
+		TOTPRequired: secret != "",
+	})
+}
+
+// confirmAccountDeletion deletes the account, then logs the user out.
+// Only a tombstone without the source address is left in the audit log
+// under the user's name.
+func confirmAccountDeletion(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+	pending := lookupConfirmation(request.PathParameter("confirmation-id"), user, 0)
+	if pending == nil || pending.Command != AuditAccountDelete {
+		writeError(request, response, http.StatusNotFound, ErrConfirmationNotFound, "Confirmation not found")
+		return
+	}
+
+	confirmation := ConfirmationRequest{}
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(&confirmation); err != nil {
+			writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse confirmation")
+			return
+		}
+	}
+
+	secret, err := gDB.GetTOTPSecret(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to delete account")
+		return
+	}
+
+	if secret != "" && !validateTOTP(secret, confirmation.Code, time.Now()) {
+		failConfirmation(pending)
+		audit(request, 0, AuditAccountDelete, "", nil, "invalid confirmation code")
+		writeError(request, response, http.StatusForbidden, ErrInvalidCode, "Invalid confirmation code")
+		return
+	}
+
+	// Its file would be left behind
+	if export, err := gDB.GetPendingExport(user); err != nil || export != nil {
+		writeError(request, response, http.StatusConflict, ErrExportInProgress, "Wait for the export in progress to complete")
+		return
+	}
+
+	if !removeConfirmation(pending) {
+		writeError(request, response, http.StatusNotFound, ErrConfirmationNotFound, "Confirmation not found")
+		return
+	}
+
+	exports, err := gDB.ListExportsForUser(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to delete account")
+		return
+	}
+
+	devices, err := gDB.DeleteAccount(user)
+	if err != nil {
+		audit(request, 0, AuditAccountDelete, "", nil, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to delete account")
+		return
+	}
+
+	for _, export := range exports {
+		if err = os.Remove(exportFile(gServerConfig, export.Id)); err != nil && !os.IsNotExist(err) {
+			slog.ErrorContext(request.Request.Context(), "Failed to delete export", "export", export.Id, "error", err)
+		}
+	}
+
+	removeConfirmationsForUser(user)
+	removePairingCodesForUser(user)
+
+	// The login name can't be kept, but an operator with the key can still
+	// check whether a given user deleted their account.
+	actor := gDB.keyedHash("actor", user)
+	arguments, _ := json.Marshal(map[string]int64{"devices": devices})
+	gDB.AddAuditEntry(&AuditEntry{
+		Actor:     actor,
+		Action:    AuditAccountDelete,
+		Arguments: string(arguments),
+		Outcome:   "ok",
+	})
+	slog.InfoContext(request.Request.Context(), AuditAccountDelete, "actor", actor, "devices", devices, "outcome", "ok")
+
+	gPersona.Logout(response.ResponseWriter, request.Request)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func createAccountWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+
+	ws.
+		Filter(withAPIRoot(root)).
+		Filter(observeRequest).
+		Filter(ensureIsLoggedIn).
+		Filter(checkCSRF).
+		Filter(rateLimited(rateLimitAPI)).
+		Path(root + "/account").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.
+		Route(ws.DELETE("").To(requestAccountDeletion).
+		Filter(rateLimited(rateLimitCommand)).
+		Doc("Request the deletion of the account, with all its devices, locations and sessions").
+		Notes("Nothing is deleted until the returned confirmation is confirmed").
+		Returns(http.StatusAccepted, "The deletion needs to be confirmed", ConfirmationResponse{}))
+
+	ws.
+		Route(ws.POST("/confirm/{confirmation-id}").To(confirmAccountDeletion).
+		Consumes("application/json").
+		Filter(rateLimited(rateLimitCommand)).
+		Doc("Confirm the deletion of the account, logging the user out").
+		Param(ws.PathParameter("confirmation-id", "The identifier returned when requesting the deletion")).
+		Reads(ConfirmationRequest{}).
+		Returns(http.StatusNoContent, "The account was deleted", nil))
+
+	ws.
+		Route(ws.PUT("/totp").To(enrollTOTP).
+		Doc("Generate a new TOTP secret used to confirm destructive commands").
+		Notes("If a secret already exists, a valid code for it must be provided").
+		Reads(ConfirmationRequest{}).
+		Writes(TOTPEnrollment{}))
+
+	ws.
+		Route(ws.DELETE("/totp").To(removeTOTP).
+		Doc("Stop requiring TOTP codes to confirm destructive commands").
+		Param(ws.QueryParameter("code", "A valid code for the current secret")))
+
+	ws.
+		Route(ws.DELETE("/locations").To(deleteLocations).
+		Doc("Delete the location history and last known location of all the user's devices"))
+
+	ws.
+		Route(ws.POST("/export").To(exportAccountData).
+		Produces("application/zip", restful.MIME_JSON).
+		Doc("Export the user's devices, location history, commands and audit log as a zip").
+		Notes("Large accounts are exported in the background: the response is then a 202 with the export to poll").
+		Param(ws.QueryParameter("async", "Export in the background even for small accounts").DataType("boolean")).
+		Returns(http.StatusAccepted, "The export was started", ExportJob{}))
+
+	ws.
+		Route(ws.GET("/export/{export-id}").To(serveExport).
+		Doc("Get the status of an export, with its download link once ready").
+		Param(ws.PathParameter("export-id", "The identifier for the export")).
+		Writes(ExportJob{}))
+
+	ws.
+		Route(ws.GET("/export/{export-id}/download").To(downloadExport).
+		Produces("application/zip", restful.MIME_JSON).
+		Doc("Download an export once ready").
+		Param(ws.PathParameter("export-id", "The identifier for the export")))
+
+	sessions := ws.GET("/sessions").To(serveSessions).
+		Doc("List the sessions the user is logged in with")
+
+	if root == "" {
+		sessions.Writes([]Session{})
+	} else {
+		sessions.Writes(SessionPage{})
+		for _, param := range pageParameters(ws) {
+			sessions.Param(param)
+		}
+	}
+
+	ws.Route(sessions)
+
+	ws.
+		Route(ws.DELETE("/sessions/{session-id}").To(revokeSession).
+		Doc("Log out a session").
+		Param(ws.PathParameter("session-id", "The identifier for the session").DataType("integer")).
+		Returns(http.StatusNoContent, "The session was logged out", nil))
+
+	ws.
+		Route(ws.DELETE("/sessions").To(revokeOtherSessions).
+		Doc("Log out every session but the current one").
+		Returns(http.StatusNoContent, "The other sessions were logged out", nil))
+
+	return ws
+}
@@ -0,0 +1,157 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "strings"
+import "testing"
+import "time"
+
+// LogoutPersona records logging out, which MockPersona refuses.
+type LogoutPersona struct {
+	MockPersona
+	loggedOut *bool
+}
+
+func (self LogoutPersona) Logout(w http.ResponseWriter, r *http.Request) {
+	*self.loggedOut = true
+}
+
+func requestTestAccountDeletion(t *testing.T) ConfirmationResponse {
+	response := doWebServiceRequest("DELETE", "/api/v1/account", "")
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	confirmation := ConfirmationResponse{}
+	json.Unmarshal(response.Body.Bytes(), &confirmation)
+	return confirmation
+}
+
+func TestDeleteAccount(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	loggedOut := false
+	gPersona = LogoutPersona{MockPersona{LoggedIn: true}, &loggedOut}
+
+	now := time.Now()
+	gDB.UpdateDeviceLocation(&gTestDevices[0], Location{Latitude: 1, Longitude: 2, Timestamp: now.Unix()})
+	gDB.AddInvocation(1234, 1, CommandContext{1, nil}, now)
+	gDB.CreateSession("ggp@mozilla.com", "session", "", "", now)
+	gDB.CreateExport("ggp@mozilla.com", "export", now)
+	gDB.FinishExport("export", ExportReady, 0, now)
+
+	confirmation := requestTestAccountDeletion(t)
+	if confirmation.Confirm != "/api/v1/account/confirm/"+confirmation.Id {
+		t.Errorf("Unexpected confirmation: %#v", confirmation)
+	}
+
+	if devices, _ := gDB.ListDevicesForUser("ggp@mozilla.com"); len(devices) != 2 {
+		t.Fatal("Devices were deleted before confirming")
+	}
+
+	// Confirmations of device commands can't delete the account
+	pending, _ := newConfirmation("ggp@mozilla.com", 1, "Wipe", CommandContext{})
+	if response := doWebServiceRequest("POST", "/api/v1/account/confirm/"+pending.Id, "{}"); response.Code != http.StatusNotFound {
+		t.Errorf("Command confirmation deleted the account: %d", response.Code)
+	}
+
+	response := doWebServiceRequest("POST", confirmation.Confirm, "{}")
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code: %d %s", response.Code, response.Body.String())
+	}
+
+	if !loggedOut {
+		t.Error("User wasn't logged out")
+	}
+
+	if devices, _ := gDB.ListDevicesForUser("ggp@mozilla.com"); len(devices) != 0 {
+		t.Errorf("Devices left: %#v", devices)
+	}
+
+	if count, _ := gDB.CountLocationsForUser("ggp@mozilla.com"); count != 0 {
+		t.Errorf("%d locations left", count)
+	}
+
+	if invocations, _ := gDB.ListInvocations(); len(invocations) != 0 {
+		t.Errorf("Invocations left: %#v", invocations)
+	}
+
+	if session, _ := gDB.GetSessionByToken("session"); session != nil {
+		t.Error("Session left")
+	}
+
+	if exports, _ := gDB.ListExportsForUser("ggp@mozilla.com"); len(exports) != 0 {
+		t.Errorf("Exports left: %#v", exports)
+	}
+
+	if pending := lookupConfirmation(pending.Id, "ggp@mozilla.com", 1); pending != nil {
+		t.Error("Pending confirmation left")
+	}
+
+	if devices, _ := gDB.ListDevicesForUser("ggoncalves@mozilla.com"); len(devices) != 1 {
+		t.Error("Another user's devices were deleted")
+	}
+
+	if entries, _ := gDB.ListAuditEntries(AuditFilter{Actor: "ggp@mozilla.com"}); len(entries) != 0 {
+		t.Errorf("Audit entries left under the user's name: %#v", entries)
+	}
+
+	entries, _ := gDB.ListAuditEntries(AuditFilter{Actor: gDB.keyedHash("actor", "ggp@mozilla.com")})
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected tombstones: %#v", entries)
+	}
+
+	tombstone := entries[0]
+	if tombstone.Action != AuditAccountDelete || tombstone.Outcome != "ok" || tombstone.SourceIP != "" ||
+		!strings.Contains(tombstone.Arguments, `"devices":2`) {
+		t.Errorf("Unexpected tombstone: %#v", tombstone)
+	}
+
+	var named int
+	gDB.connection.QueryRow(`select count(*) from audit_log where
+		actor like '%ggp@mozilla.com%' or arguments like '%ggp@mozilla.com%'`).Scan(&named)
+	if named != 0 {
+		t.Errorf("%d audit entries still name the user", named)
+	}
+
+	// Pseudonymised entries are still append-only
+	if _, err := gDB.connection.Exec(`update audit_log set outcome="ok" where actor=""`); err == nil {
+		t.Error("Pseudonymised audit entries were changed")
+	}
+
+	// Confirmations are single use
+	if response := doWebServiceRequest("POST", confirmation.Confirm, "{}"); response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
+
+func TestDeleteAccountWithTOTP(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	secret, _ := generateTOTPSecret()
+	gDB.SetTOTPSecret("ggp@mozilla.com", secret)
+
+	confirmation := requestTestAccountDeletion(t)
+	if !confirmation.TOTPRequired {
+		t.Errorf("Confirmation doesn't require TOTP: %#v", confirmation)
+	}
+
+	response := doWebServiceRequest("POST", confirmation.Confirm, `{"code": "000000"}`)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	if devices, _ := gDB.ListDevicesForUser("ggp@mozilla.com"); len(devices) != 2 {
+		t.Error("Account was deleted with an invalid code")
+	}
+
+	// Exports in progress would leave their file behind
+	gDB.CreateExport("ggp@mozilla.com", "export", time.Now())
+	code, _ := totpCode(secret, time.Now().Unix()/totpPeriod)
+	response = doWebServiceRequest("POST", confirmation.Confirm, `{"code": "`+code+`"}`)
+	if response.Code != http.StatusConflict {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
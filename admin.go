@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Admin commands operate on the database directly, for operators to
+// inspect and fix data. They are given after the flags, e.g.
+//
+//	whereismyfox -db db.sqlite devices show 12
+//
+// Without a command, or with serve, the server is started.
+type adminCommand struct {
+	name string
+	args string
+	doc  string
+
+	// Number of arguments, or -1 for a single optional one
+	nargs int
+
+	run func(db *DB, w io.Writer, args []string) error
+}
+
+var gAdminCommands = []adminCommand{
+	{"devices list", "[user]", "List the devices of a user, or of everyone", -1, adminListDevices},
+	{"devices show", "<device-id>", "Show a device with its commands", 1, adminShowDevice},
+	{"devices delete", "<device-id>", "Delete a device with its location history", 1, adminDeleteDevice},
+	{"commands list", "", "List the commands devices can support", 0, adminListCommands},
+	{"commands import", "<file>", "Add or update commands from a file like commands.json", 1, adminImportCommands},
+	{"invocations list", "", "List commands pushed to devices which didn't fetch them yet", 0, adminListInvocations},
+	{"users list", "", "List users with their number of devices and sessions", 0, adminListUsers},
+	{"db backup", "[file]", "Write a consistent copy of the database to a new file, or to backupDir", -1, adminBackupDB},
+	{"db restore", "<file>", "Replace the database with a backup, with the server stopped", 1, adminRestoreDB},
+	{"db vacuum", "", "Rebuild the database, reclaiming unused space", 0, adminVacuumDB},
+}
+
+func findAdminCommand(args []string) (*adminCommand, []string) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+
+	name := args[0] + " " + args[1]
+	for i := range gAdminCommands {
+		if gAdminCommands[i].name == name {
+			return &gAdminCommands[i], args[2:]
+		}
+	}
+
+	return nil, nil
+}
+
+func printAdminUsage(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "  serve\t\tStart the server (default)\n")
+	for _, command := range gAdminCommands {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", command.name, command.args, command.doc)
+	}
+	tw.Flush()
+}
+
+// runAdminCommand runs the command given by args against db, writing its
+// output to w.
+func runAdminCommand(db *DB, w io.Writer, args []string) error {
+	command, rest := findAdminCommand(args)
+	if command == nil {
+		return fmt.Errorf("Unknown command %q", strings.Join(args, " "))
+	}
+
+	if command.nargs >= 0 && len(rest) != command.nargs || len(rest) > 1 {
+		return fmt.Errorf("Usage: %s %s", command.name, command.args)
+	}
+
+	return command.run(db, w, rest)
+}
+
+func parseDeviceId(arg string) (int64, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid device id %q", arg)
+	}
+	return id, nil
+}
+
+func formatTimestamp(timestamp int64) string {
+	if timestamp == 0 {
+		return "-"
+	}
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+func (self DB) ListDevices() ([]Device, error) {
+	res, err := self.connection.Query(
+		`select ` + deviceColumns + ` from devices order by id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	devices := []Device{}
+	for res.Next() {
+		d, err := self.scanDevice(res)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, *d)
+	}
+
+	return devices, res.Err()
+}
+
+func (self DB) ListCommands() ([]Command, error) {
+	res, err := self.connection.Query(
+		`select id, name, description, destructive from commands order by id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	commands := []Command{}
+	for res.Next() {
+		c := Command{}
+		if err = res.Scan(&c.Id, &c.Name, &c.Description, &c.Destructive); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+
+	return commands, res.Err()
+}
+
+// DeleteDevice removes the device along with everything referring to it,
+// except the audit log.
+func (self DB) DeleteDevice(id int64) error {
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		`delete from locations where device_id=?`,
+		`delete from commands_for_device where device_id=?`,
+		`delete from invocations where device_id=?`,
+		`delete from devices where id=?`,
+	} {
+		if _, err = tx.Exec(statement, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (self DB) Vacuum() error {
+	_, err := self.connection.Exec(`vacuum`)
+	return err
+}
+
+func adminListDevices(db *DB, w io.Writer, args []string) error {
+	var devices []Device
+	var err error
+	if len(args) == 1 {
+		devices, err = db.ListDevicesForUser(args[0])
+	} else {
+		devices, err = db.ListDevices()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tNAME\tLAST SEEN")
+	for _, d := range devices {
+		lastSeen, _ := strconv.ParseInt(d.Timestamp, 10, 64)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", d.Id, d.User, d.Name, formatTimestamp(lastSeen))
+	}
+	return tw.Flush()
+}
+
+func adminShowDevice(db *DB, w io.Writer, args []string) error {
+	id, err := parseDeviceId(args[0])
+	if err != nil {
+		return err
+	}
+
+	device, err := db.GetDeviceById(id)
+	if err != nil {
+		return fmt.Errorf("No device %d", id)
+	}
+
+	commands, err := db.ListCommandsForDevice(device)
+	if err != nil {
+		return err
+	}
+
+	lastSeen, _ := strconv.ParseInt(device.Timestamp, 10, 64)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\t%d\n", device.Id)
+	fmt.Fprintf(tw, "User\t%s\n", device.User)
+	fmt.Fprintf(tw, "Name\t%s\n", device.Name)
+	fmt.Fprintf(tw, "Endpoint\t%s\n", device.Endpoint)
+	fmt.Fprintf(tw, "Location\t%f, %f\n", device.Latitude, device.Longitude)
+	if device.Address != "" {
+		fmt.Fprintf(tw, "Address\t%s\n", device.Address)
+	}
+	fmt.Fprintf(tw, "Last seen\t%s\n", formatTimestamp(lastSeen))
+
+	names := []string{}
+	for _, c := range commands {
+		names = append(names, c.Name)
+	}
+	fmt.Fprintf(tw, "Commands\t%s\n", strings.Join(names, ", "))
+
+	return tw.Flush()
+}
+
+func adminDeleteDevice(db *DB, w io.Writer, args []string) error {
+	id, err := parseDeviceId(args[0])
+	if err != nil {
+		return err
+	}
+
+	device, err := db.GetDeviceById(id)
+	if err != nil {
+		return fmt.Errorf("No device %d", id)
+	}
+
+	if err = db.DeleteDevice(id); err != nil {
+		return err
+	}
+
+	// Recorded for the owner, who can't tell otherwise where it went
+	arguments, _ := json.Marshal(map[string]string{"name": device.Name, "by": "admin"})
+	db.AddAuditEntry(&AuditEntry{
+		Actor:     device.User,
+		DeviceId:  id,
+		Action:    AuditDeviceDelete,
+		Arguments: string(arguments),
+		Outcome:   "ok",
+	})
+
+	fmt.Fprintf(w, "Deleted device %d (%s) of %s\n", id, device.Name, device.User)
+	return nil
+}
+
+func adminListCommands(db *DB, w io.Writer, args []string) error {
+	commands, err := db.ListCommands()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tDESTRUCTIVE\tDESCRIPTION")
+	for _, c := range commands {
+		fmt.Fprintf(tw, "%d\t%s\t%t\t%s\n", c.Id, c.Name, c.Destructive, c.Description)
+	}
+	return tw.Flush()
+}
+
+func adminImportCommands(db *DB, w io.Writer, args []string) error {
+	if err := populateCommandsDB(db, args[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Imported commands from %s\n", args[0])
+	return nil
+}
+
+func adminListInvocations(db *DB, w io.Writer, args []string) error {
+	invocations, err := db.ListInvocations()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tDEVICE\tCOMMAND\tARGUMENTS\tPUSHED")
+	for _, i := range invocations {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%v\t%s\n", i.Token, i.DeviceId, i.CommandId, i.Arguments, formatTimestamp(i.Created))
+	}
+	return tw.Flush()
+}
+
+func adminListUsers(db *DB, w io.Writer, args []string) error {
+	users, err := db.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tDEVICES\tSESSIONS")
+	for _, user := range users {
+		devices, err := db.ListDevicesForUser(user)
+		if err != nil {
+			return err
+		}
+
+		sessions, err := db.ListSessions(user)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", user, len(devices), len(sessions))
+	}
+	return tw.Flush()
+}
+
+// adminBackupDB backs up to the given file, compressed if it ends in .gz,
+// or else into backupDir, applying backupRetain.
+func adminBackupDB(db *DB, w io.Writer, args []string) error {
+	var info *BackupInfo
+	var err error
+	if len(args) == 1 {
+		info, err = backupDatabase(db, args[0])
+	} else {
+		info, err = backupToDir(db, gServerConfig, time.Now())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Backed up the database to %s (%d bytes)\n", info.File, info.Size)
+	return nil
+}
+
+func adminRestoreDB(db *DB, w io.Writer, args []string) error {
+	db.Close()
+
+	if err := restoreDatabase(db.path, args[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Restored %s from %s, the previous database is %s.before-restore\n", db.path, args[0], db.path)
+	return nil
+}
+
+func adminVacuumDB(db *DB, w io.Writer, args []string) error {
+	return db.Vacuum()
+}
@@ -0,0 +1,155 @@
+package main
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func runTestAdminCommand(t *testing.T, db *DB, args ...string) string {
+	output := &bytes.Buffer{}
+	if err := runAdminCommand(db, output, args); err != nil {
+		t.Fatalf("%s failed: %s", strings.Join(args, " "), err)
+	}
+	return output.String()
+}
+
+func TestAdminCommands(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	output := runTestAdminCommand(t, db, "devices", "list")
+	for _, device := range gTestDevices {
+		if !strings.Contains(output, device.Name) {
+			t.Errorf("%s is missing from the list of devices:\n%s", device.Name, output)
+		}
+	}
+
+	output = runTestAdminCommand(t, db, "devices", "list", "ggoncalves@mozilla.com")
+	if strings.Contains(output, "test-device1") || !strings.Contains(output, "test-device3") {
+		t.Errorf("Unexpected devices of a user:\n%s", output)
+	}
+
+	output = runTestAdminCommand(t, db, "devices", "show", "3")
+	if !strings.Contains(output, gTestDevices[2].Endpoint) || !strings.Contains(output, "Track, Untrack, Wipe") {
+		t.Errorf("Unexpected device:\n%s", output)
+	}
+
+	output = runTestAdminCommand(t, db, "users", "list")
+	if !strings.Contains(output, "ggp@mozilla.com") || !strings.Contains(output, "ggoncalves@mozilla.com") {
+		t.Errorf("Unexpected users:\n%s", output)
+	}
+
+	db.AddInvocation(1234, 1, CommandContext{1, map[string]bool{"loud": true}}, time.Now())
+	output = runTestAdminCommand(t, db, "invocations", "list")
+	if !strings.Contains(output, "1234") || !strings.Contains(output, "loud:true") {
+		t.Errorf("Unexpected invocations:\n%s", output)
+	}
+
+	db.UpdateDeviceLocation(&gTestDevices[0], Location{Latitude: 1, Longitude: 2, Timestamp: time.Now().Unix()})
+	runTestAdminCommand(t, db, "devices", "delete", "1")
+
+	if _, err := db.GetDeviceById(1); err == nil {
+		t.Error("Device wasn't deleted")
+	}
+
+	if invocations, _ := db.ListInvocations(); len(invocations) != 0 {
+		t.Errorf("Invocations of the deleted device are left: %#v", invocations)
+	}
+
+	entries, _ := db.ListAuditEntries(AuditFilter{Actor: "ggp@mozilla.com", Limit: -1})
+	if len(entries) != 1 || entries[0].Action != AuditDeviceDelete || entries[0].DeviceId != 1 {
+		t.Errorf("Unexpected audit log: %#v", entries)
+	}
+
+	for _, args := range [][]string{{"devices", "show"}, {"devices", "show", "x"}, {"devices", "fly"}, {"db"}} {
+		if err := runAdminCommand(db, ioutil.Discard, args); err == nil {
+			t.Errorf("%v didn't fail", args)
+		}
+	}
+}
+
+func TestAdminCommandCatalog(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "whereismyfoxadmin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "commands.json")
+	ioutil.WriteFile(file, []byte(`[
+		{"id": 3, "name": "Erase", "description": "Erase the device", "destructive": true},
+		{"id": 4, "name": "Ring", "description": "Ring the device"}]`), 0600)
+
+	runTestAdminCommand(t, db, "commands", "import", file)
+
+	output := runTestAdminCommand(t, db, "commands", "list")
+	for _, name := range []string{"Track", "Erase", "Ring"} {
+		if !strings.Contains(output, name) {
+			t.Errorf("%s is missing from the commands:\n%s", name, output)
+		}
+	}
+
+	if strings.Contains(output, "Wipe") {
+		t.Errorf("Command wasn't updated:\n%s", output)
+	}
+
+	backup := filepath.Join(dir, "backup.sqlite")
+	runTestAdminCommand(t, db, "db", "backup", backup)
+
+	if err := runAdminCommand(db, ioutil.Discard, []string{"db", "backup", backup}); err == nil {
+		t.Error("Existing backup was overwritten")
+	}
+
+	copy, err := OpenDB(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copy.Close()
+
+	if commands, _ := copy.ListCommands(); len(commands) != 4 {
+		t.Errorf("Unexpected commands in backup: %#v", commands)
+	}
+
+	runTestAdminCommand(t, db, "db", "vacuum")
+}
+
+func TestTakeInvocation(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	if err := db.AddInvocation(42, 2, CommandContext{3, nil}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	invocation, err := db.TakeInvocation(42, 0)
+	if err != nil || invocation == nil || invocation.CommandId != 3 || invocation.DeviceId != 2 {
+		t.Fatalf("Unexpected invocation: %#v, %v", invocation, err)
+	}
+
+	if invocation, _ := db.TakeInvocation(42, 0); invocation != nil {
+		t.Error("Invocation was retrieved twice")
+	}
+}
+
+func TestPruneInvocations(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	now := time.Now()
+	db.AddInvocation(1, 2, CommandContext{3, nil}, now.Add(-invocationLifetime-time.Hour))
+	db.AddInvocation(2, 2, CommandContext{3, nil}, now)
+
+	if pruned, err := db.PruneInvocations(now.Add(-invocationLifetime).Unix()); err != nil || pruned != 1 {
+		t.Errorf("Unexpected pruning: %d, %v", pruned, err)
+	}
+
+	if invocations, _ := db.ListInvocations(); len(invocations) != 1 || invocations[0].Token != 2 {
+		t.Errorf("Unexpected invocations left: %#v", invocations)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The web services are registered twice: under /api/v1, and at their
+// original paths for older clients. Both share their handlers, which
+// check apiRoot to tell them apart. Only the versioned API reports errors
+// as JSON and wraps lists in pages.
+const apiV1Root = "/api/v1"
+
+const apiRootAttribute = "apiRoot"
+
+// Error codes reported by the versioned API, so that clients don't need
+// to match messages.
+const (
+	ErrNotLoggedIn           = "not_logged_in"
+	ErrInvalidRequest        = "invalid_request"
+	ErrInvalidLocation       = "invalid_location"
+	ErrDeviceNotFound        = "device_not_found"
+	ErrCommandNotFound       = "command_not_found"
+	ErrInvocationNotFound    = "invocation_not_found"
+	ErrConfirmationNotFound  = "confirmation_not_found"
+	ErrInvalidCode           = "invalid_code"
+	ErrPushFailed            = "push_failed"
+	ErrInternal              = "internal_error"
+	ErrNotFound              = "not_found"
+	ErrMethodNotAllowed      = "method_not_allowed"
+	ErrNotAcceptable         = "not_acceptable"
+	ErrUnsupportedMediaType  = "unsupported_media_type"
+	ErrRequestEntityTooLarge = "request_entity_too_large"
+	ErrRateLimited           = "rate_limited"
+	ErrInvalidCSRFToken      = "invalid_csrf_token"
+	ErrSessionNotFound       = "session_not_found"
+	ErrExportNotFound        = "export_not_found"
+	ErrExportNotReady        = "export_not_ready"
+	ErrExportInProgress      = "export_in_progress"
+	ErrPairingCodeNotFound   = "pairing_code_not_found"
+	ErrPairingLocked         = "pairing_locked"
+)
+
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Pages of list endpoints in the versioned API.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+type Pagination struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+type DevicePage struct {
+	Items []Device `json:"items"`
+	Pagination
+}
+
+type CommandPage struct {
+	Items []CommandResponse `json:"items"`
+	Pagination
+}
+
+type AuditPage struct {
+	Items []AuditEntry `json:"items"`
+	Pagination
+}
+
+func withAPIRoot(root string) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		request.SetAttribute(apiRootAttribute, root)
+		chain.ProcessFilter(request, response)
+	}
+}
+
+func apiRoot(request *restful.Request) string {
+	root, _ := request.Attribute(apiRootAttribute).(string)
+	return root
+}
+
+func isVersionedAPI(request *restful.Request) bool {
+	return apiRoot(request) != ""
+}
+
+// legacyStatus keeps the status older clients were given for errors the
+// versioned API reports more precisely.
+func legacyStatus(request *restful.Request, status, legacy int) int {
+	if isVersionedAPI(request) {
+		return status
+	}
+	return legacy
+}
+
+func writeError(request *restful.Request, response *restful.Response, status int, code, message string) {
+	writeErrorDetails(request, response, status, code, message, nil)
+}
+
+// writeErrorDetails writes the error as JSON for the versioned API, and
+// as plain text for older clients.
+func writeErrorDetails(request *restful.Request, response *restful.Response, status int, code, message string, details interface{}) {
+	if !isVersionedAPI(request) {
+		response.WriteErrorString(status, message)
+		return
+	}
+
+	response.WriteHeaderAndJson(status, APIErrorResponse{APIError{code, message, details}}, restful.MIME_JSON)
+}
+
+// Errors raised by the container itself, e.g. for unknown routes, before
+// any web service is involved.
+var gServiceErrorCodes = map[int]string{
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusMethodNotAllowed:      ErrMethodNotAllowed,
+	http.StatusNotAcceptable:         ErrNotAcceptable,
+	http.StatusUnsupportedMediaType:  ErrUnsupportedMediaType,
+	http.StatusRequestEntityTooLarge: ErrRequestEntityTooLarge,
+}
+
+func writeServiceError(serviceError restful.ServiceError, request *restful.Request, response *restful.Response) {
+	if strings.HasPrefix(request.Request.URL.Path, apiV1Root+"/") {
+		request.SetAttribute(apiRootAttribute, apiV1Root)
+	}
+
+	code, exists := gServiceErrorCodes[serviceError.Code]
+	if !exists {
+		code = ErrInvalidRequest
+	}
+
+	message := serviceError.Message
+	if message == "" {
+		message = http.StatusText(serviceError.Code)
+	}
+
+	writeError(request, response, serviceError.Code, code, message)
+}
+
+// parsePagination reads the limit and offset query parameters.
+func parsePagination(request *restful.Request) (Pagination, error) {
+	page := Pagination{Limit: defaultPageLimit}
+
+	if str := request.QueryParameter("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		page.Limit = limit
+	}
+
+	if str := request.QueryParameter("offset"); str != "" {
+		offset, err := strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			return page, fmt.Errorf("offset must be a positive number")
+		}
+		page.Offset = offset
+	}
+
+	return page, nil
+}
+
+// bounds returns the range of a page in a list of total items.
+func (self *Pagination) bounds(total int) (int, int) {
+	self.Total = total
+
+	start := self.Offset
+	if start > total {
+		start = total
+	}
+
+	end := start + self.Limit
+	if end > total {
+		end = total
+	}
+
+	return start, end
+}
+
+func pageParameters(ws *restful.WebService) []*restful.Parameter {
+	return []*restful.Parameter{
+		ws.QueryParameter("limit", fmt.Sprintf("Maximum number of items to return, %d by default and at most %d", defaultPageLimit, maxPageLimit)).DataType("integer"),
+		ws.QueryParameter("offset", "Number of items to skip").DataType("integer"),
+	}
+}
+
+// serveUnknownAPI answers requests under /api/ that no web service
+// handles, which would otherwise get the web interface.
+func serveUnknownAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", restful.MIME_JSON)
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(APIErrorResponse{APIError{Code: ErrNotFound, Message: "Not Found"}})
+}
+
+func registerWebServices() {
+	restful.DefaultContainer.ServiceErrorHandler(writeServiceError)
+	http.HandleFunc("/api/", serveUnknownAPI)
+
+	for _, root := range []string{apiV1Root, ""} {
+		restful.Add(createDeviceWebService(root))
+		restful.Add(createAuditWebService(root))
+		restful.Add(createAccountWebService(root))
+		restful.Add(createPairingWebService(root))
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type AuditEntry struct {
+	Id        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`
+	DeviceId  int64  `json:"deviceId"`
+	Action    string `json:"action"`
+	Command   string `json:"command"`
+	Arguments string `json:"arguments"`
+	SourceIP  string `json:"sourceIp"`
+	Outcome   string `json:"outcome"`
+}
+
+// AuditFilter narrows down a listing of the audit log. Zero values
+// mean "don't filter on this field".
+type AuditFilter struct {
+	Actor    string
+	DeviceId int64
+	Action   string
+	Command  string
+	From     int64
+	To       int64
+	Limit    int
+	Offset   int
+}
+
+const (
+	AuditDeviceAdd       = "device.add"
+	AuditDeviceDelete    = "device.delete"
+	AuditDeviceCommands  = "device.commands"
+	AuditCommand         = "command"
+	AuditTOTPEnroll      = "totp.enroll"
+	AuditTOTPRemove      = "totp.remove"
+	AuditLocationsDelete = "locations.delete"
+	AuditSessionRevoke   = "session.revoke"
+	AuditAccountExport   = "account.export"
+	AuditAccountDelete   = "account.delete"
+	AuditPairingCode     = "pairing.code"
+)
+
+func (self DB) AddAuditEntry(entry *AuditEntry) error {
+	res, err := self.connection.Exec(
+		`insert into audit_log
+		(timestamp, actor, device_id, action, command, arguments, source_ip, outcome)
+		values(strftime('%s', 'now'), ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Actor, entry.DeviceId, entry.Action, entry.Command,
+		entry.Arguments, entry.SourceIP, entry.Outcome)
+
+	if err != nil {
+		return err
+	}
+
+	entry.Id, _ = res.LastInsertId()
+	return nil
+}
+
+// where returns the conditions of the filter, and their arguments.
+func (self AuditFilter) where() (string, []interface{}) {
+	query := ` where 1=1`
+	args := []interface{}{}
+
+	if self.Actor != "" {
+		query += " and actor=?"
+		args = append(args, self.Actor)
+	}
+
+	if self.DeviceId != 0 {
+		query += " and device_id=?"
+		args = append(args, self.DeviceId)
+	}
+
+	if self.Action != "" {
+		query += " and action=?"
+		args = append(args, self.Action)
+	}
+
+	if self.Command != "" {
+		query += " and command=?"
+		args = append(args, self.Command)
+	}
+
+	if self.From != 0 {
+		query += " and timestamp>=?"
+		args = append(args, self.From)
+	}
+
+	if self.To != 0 {
+		query += " and timestamp<=?"
+		args = append(args, self.To)
+	}
+
+	return query, args
+}
+
+func (self DB) CountAuditEntries(filter AuditFilter) (int, error) {
+	where, args := filter.where()
+
+	var count int
+	err := self.connection.QueryRow(`select count(*) from audit_log`+where, args...).Scan(&count)
+	return count, err
+}
+
+func (self DB) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	where, args := filter.where()
+	query := `select id, timestamp, actor, device_id, action, command,
+		arguments, source_ip, outcome from audit_log` + where + ` order by id`
+
+	if filter.Limit > 0 || filter.Offset > 0 {
+		// A negative limit is no limit at all
+		limit := filter.Limit
+		if limit == 0 {
+			limit = -1
+		}
+
+		query += " limit ? offset ?"
+		args = append(args, limit, filter.Offset)
+	}
+
+	res, err := self.connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	entries := make([]AuditEntry, 0)
+	for res.Next() {
+		e := AuditEntry{}
+		err = res.Scan(&e.Id, &e.Timestamp, &e.Actor, &e.DeviceId, &e.Action,
+			&e.Command, &e.Arguments, &e.SourceIP, &e.Outcome)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, res.Err()
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records an event on behalf of the user logged in for the request.
+// Failing to write the audit log must not break the request itself, so
+// errors are only logged.
+func audit(request *restful.Request, deviceId int64, action, command string, arguments interface{}, outcome string) {
+	entry := AuditEntry{
+		Actor:    requestUser(request),
+		DeviceId: deviceId,
+		Action:   action,
+		Command:  command,
+		SourceIP: sourceIP(request.Request),
+		Outcome:  outcome,
+	}
+
+	if arguments != nil {
+		if data, err := json.Marshal(arguments); err == nil {
+			entry.Arguments = string(data)
+		}
+	}
+
+	ctx := request.Request.Context()
+	slog.InfoContext(ctx, action,
+		"actor", entry.Actor,
+		"device_id", deviceId,
+		"command", command,
+		"outcome", outcome)
+
+	if err := gDB.AddAuditEntry(&entry); err != nil {
+		slog.ErrorContext(ctx, "Failed to write audit entry", "error", err)
+	}
+}
+
+func parseAuditFilter(request *restful.Request) (AuditFilter, error) {
+	filter := AuditFilter{
+		Actor:   gPersona.GetLoginName(request.Request),
+		Action:  request.QueryParameter("action"),
+		Command: request.QueryParameter("command"),
+	}
+
+	ints := []struct {
+		name  string
+		value *int64
+	}{
+		{"device", &filter.DeviceId},
+		{"from", &filter.From},
+		{"to", &filter.To},
+	}
+
+	for _, param := range ints {
+		str := request.QueryParameter(param.name)
+		if str == "" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("Failed to parse %s", param.name)
+		}
+		*param.value = value
+	}
+
+	if isVersionedAPI(request) {
+		page, err := parsePagination(request)
+		filter.Limit, filter.Offset = page.Limit, page.Offset
+		return filter, err
+	}
+
+	if str := request.QueryParameter("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit < 0 {
+			return filter, fmt.Errorf("Failed to parse limit")
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func wantsCSV(request *restful.Request) bool {
+	if format := request.QueryParameter("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(request.HeaderParameter("Accept"), "text/csv")
+}
+
+func writeAuditCSV(response *restful.Response, entries []AuditEntry) {
+	response.AddHeader("Content-Type", "text/csv")
+	response.AddHeader("Content-Disposition", `attachment; filename="audit.csv"`)
+
+	w := csv.NewWriter(response)
+	w.Write([]string{"id", "timestamp", "actor", "device", "action",
+		"command", "arguments", "source_ip", "outcome"})
+
+	for _, e := range entries {
+		w.Write([]string{
+			strconv.FormatInt(e.Id, 10),
+			strconv.FormatInt(e.Timestamp, 10),
+			e.Actor,
+			strconv.FormatInt(e.DeviceId, 10),
+			e.Action,
+			e.Command,
+			e.Arguments,
+			e.SourceIP,
+			e.Outcome,
+		})
+	}
+
+	w.Flush()
+}
+
+func serveAuditLog(request *restful.Request, response *restful.Response) {
+	filter, err := parseAuditFilter(request)
+	if err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	entries, err := gDB.ListAuditEntries(filter)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve audit log")
+		return
+	}
+
+	if wantsCSV(request) {
+		writeAuditCSV(response, entries)
+		return
+	}
+
+	if !isVersionedAPI(request) {
+		response.WriteEntity(entries)
+		return
+	}
+
+	total, err := gDB.CountAuditEntries(filter)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve audit log")
+		return
+	}
+
+	response.WriteEntity(AuditPage{entries, Pagination{total, filter.Limit, filter.Offset}})
+}
+
+func createAuditWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+
+	ws.
+		Filter(withAPIRoot(root)).
+		Filter(observeRequest).
+		Filter(ensureIsLoggedIn).
+		Filter(checkCSRF).
+		Filter(rateLimited(rateLimitAPI)).
+		Path(root + "/audit").
+		Produces(restful.MIME_JSON, "text/csv")
+
+	list := ws.GET("/").To(serveAuditLog).
+		Doc("Retrieve the audit log for the logged in user").
+		Param(ws.QueryParameter("device", "Only entries for this device id").DataType("integer")).
+		Param(ws.QueryParameter("action", "Only entries for this action")).
+		Param(ws.QueryParameter("command", "Only entries for this command name")).
+		Param(ws.QueryParameter("from", "Only entries at or after this unix timestamp").DataType("integer")).
+		Param(ws.QueryParameter("to", "Only entries at or before this unix timestamp").DataType("integer")).
+		Param(ws.QueryParameter("format", "Either json (default) or csv"))
+
+	if root == "" {
+		list.
+			Param(ws.QueryParameter("limit", "Maximum number of entries to return").DataType("integer")).
+			Writes([]AuditEntry{})
+	} else {
+		for _, param := range pageParameters(ws) {
+			list.Param(param)
+		}
+		list.Writes(AuditPage{})
+	}
+
+	ws.Route(list)
+
+	return ws
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backups are snapshots taken with VACUUM INTO, which reads the database
+// in a single transaction and so is consistent even while the server
+// writes to it. Copying the file instead can catch a write halfway.
+// Backups whose name ends in .gz are compressed.
+const (
+	backupPrefix   = "whereismyfox-"
+	backupSuffix   = ".sqlite"
+	backupTimeForm = "20060102T150405Z"
+)
+
+type BackupInfo struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+}
+
+// Serializes backups, so that two taken within a second don't pick the
+// same name.
+var gBackupLock sync.Mutex
+
+// Backup writes a copy of the database to a file, which must not exist.
+// Unlike copying the file, this is safe while the server is running.
+func (self DB) Backup(file string) error {
+	_, err := self.connection.Exec(`vacuum into ?`, file)
+	return err
+}
+
+func isCompressedBackup(file string) bool {
+	return strings.HasSuffix(file, ".gz")
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	compressed := gzip.NewWriter(out)
+	if _, err = io.Copy(compressed, in); err == nil {
+		err = compressed.Close()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// backupDatabase writes a snapshot of db to file, compressed if the name
+// ends in .gz. The snapshot is written next to file first, so that an
+// interrupted backup never leaves a truncated file behind.
+func backupDatabase(db *DB, file string) (*BackupInfo, error) {
+	if _, err := os.Stat(file); err == nil {
+		return nil, fmt.Errorf("%s already exists", file)
+	}
+
+	start := time.Now()
+	snapshot := file + ".partial"
+	os.Remove(snapshot)
+	defer os.Remove(snapshot)
+
+	if err := db.Backup(snapshot); err != nil {
+		return nil, err
+	}
+
+	if isCompressedBackup(file) {
+		compressed := snapshot + ".gz"
+		defer os.Remove(compressed)
+
+		if err := gzipFile(snapshot, compressed); err != nil {
+			return nil, err
+		}
+		snapshot = compressed
+	}
+
+	if err := os.Rename(snapshot, file); err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("backup", "file", file, "size", stat.Size(),
+		"duration_ms", time.Since(start).Milliseconds())
+
+	return &BackupInfo{file, stat.Size(), start.Unix()}, nil
+}
+
+func backupFileName(now time.Time, compress bool) string {
+	name := backupPrefix + now.UTC().Format(backupTimeForm) + backupSuffix
+	if compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// listBackups returns the backups in dir, oldest first. Their names sort
+// by the time they were taken.
+func listBackups(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+
+		if strings.HasSuffix(name, backupSuffix) || strings.HasSuffix(name, backupSuffix+".gz") {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// pruneBackups deletes all but the keep most recent backups in dir. Zero
+// keeps them all.
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > keep {
+		if err = os.Remove(backups[0]); err != nil {
+			return err
+		}
+		slog.Info("backup.prune", "file", backups[0])
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// backupToDir takes a backup into the configured backup directory, then
+// applies the retention.
+func backupToDir(db *DB, config ServerConfig, now time.Time) (*BackupInfo, error) {
+	gBackupLock.Lock()
+	defer gBackupLock.Unlock()
+
+	if err := os.MkdirAll(config.BackupDir, 0700); err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(config.BackupDir, backupFileName(now, config.BackupCompress))
+	info, err := backupDatabase(db, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pruneBackups(config.BackupDir, config.BackupRetain); err != nil {
+		slog.Error("Failed to prune backups", "dir", config.BackupDir, "error", err)
+	}
+
+	return info, nil
+}
+
+// startBackupScheduler takes a backup every BackupIntervalHours until the
+// returned function is called. A zero interval disables it.
+func startBackupScheduler(db *DB) func() {
+	if gServerConfig.BackupIntervalHours <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(gServerConfig.BackupIntervalHours) * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			if _, err := backupToDir(db, gServerConfig, time.Now()); err != nil {
+				slog.Error("Failed to back up database", "error", err)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func isGzipFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic, err := bufio.NewReader(f).Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+func gunzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	decompressed, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, decompressed)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// validateBackup checks that file is an intact database of this server,
+// with a schema no newer than this release knows. Older schemas are
+// migrated when the database is next opened.
+func validateBackup(file string) error {
+	conn, err := sql.Open(timedSQLiteDriver, "file:"+file+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var integrity string
+	if err = conn.QueryRow(`pragma integrity_check`).Scan(&integrity); err != nil {
+		return fmt.Errorf("%s is not a database: %s", file, err)
+	}
+
+	if integrity != "ok" {
+		return fmt.Errorf("%s is corrupt: %s", file, integrity)
+	}
+
+	var tables int
+	err = conn.QueryRow(
+		`select count(*) from sqlite_master where type='table' and name='devices'`).Scan(&tables)
+
+	if err != nil {
+		return err
+	}
+
+	if tables == 0 {
+		return fmt.Errorf("%s is not a whereismyfox database", file)
+	}
+
+	var version int
+	if err = conn.QueryRow(`pragma user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("%s has schema version %d, newer than %d of this release", file, version, len(migrations))
+	}
+
+	return nil
+}
+
+// lockDatabase takes an exclusive lock on dbFile.lock, held until the
+// returned file is closed. The server holds it while serving, since a
+// database replaced under it would keep being written to as the old file.
+func lockDatabase(dbFile string) (*os.File, error) {
+	lock, err := os.OpenFile(dbFile+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%s is in use by a running server", dbFile)
+	}
+	return lock, nil
+}
+
+// restoreDatabase replaces dbFile with the backup, once it was validated.
+// The database must not be open, and the server not running, which the
+// lock on dbFile.lock ensures. The replaced database is kept as
+// dbFile.before-restore.
+func restoreDatabase(dbFile, backup string) error {
+	lock, err := lockDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	candidate := dbFile + ".restore"
+	defer os.Remove(candidate)
+
+	compressed, err := isGzipFile(backup)
+	if err != nil {
+		return err
+	}
+
+	if compressed {
+		err = gunzipFile(backup, candidate)
+	} else {
+		err = copyFile(backup, candidate)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err = validateBackup(candidate); err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(dbFile + "-journal"); err == nil {
+		return fmt.Errorf("%s has a pending journal, open it once to recover it before restoring", dbFile)
+	}
+
+	if _, err = os.Stat(dbFile); err == nil {
+		if err = os.Rename(dbFile, dbFile+".before-restore"); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(candidate, dbFile)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func isAdminRequest(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return gServerConfig.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(gServerConfig.AdminToken)) == 1
+}
+
+// serveBackup takes a backup into the backup directory. It is meant for
+// operators and scripts rather than users, and takes the admin token
+// instead of a login.
+func serveBackup(w http.ResponseWriter, r *http.Request) {
+	if gServerConfig.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isAdminRequest(r) {
+		slog.WarnContext(r.Context(), "backup", "outcome", "unauthorized", "source_ip", sourceIP(r))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	info, err := backupToDir(gDB, gServerConfig, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to back up database", "error", err)
+		http.Error(w, "Failed to back up database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+func setupAdminHandlers() {
+	http.HandleFunc("/admin/backup", serveBackup)
+}
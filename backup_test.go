@@ -0,0 +1,209 @@
+package main
+
+import "database/sql"
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func tempBackupDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "whereismyfoxbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestBackupRetention(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	dir, cleanupDir := tempBackupDir(t)
+	defer cleanupDir()
+
+	config := defaultConfig()
+	config.BackupDir = dir
+	config.BackupCompress = true
+	config.BackupRetain = 2
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		info, err := backupToDir(db, config, now.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasSuffix(info.File, ".sqlite.gz") || info.Size == 0 {
+			t.Errorf("Unexpected backup: %#v", info)
+		}
+	}
+
+	backups, err := listBackups(dir)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("Unexpected backups: %v, %v", backups, err)
+	}
+
+	if backups[1] != filepath.Join(dir, backupFileName(now.Add(2*time.Hour), true)) {
+		t.Errorf("The most recent backup wasn't kept: %v", backups)
+	}
+}
+
+func TestRestoreDatabase(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	dir, cleanupDir := tempBackupDir(t)
+	defer cleanupDir()
+
+	backup := filepath.Join(dir, "backup.sqlite.gz")
+	if _, err := backupDatabase(db, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backupDatabase(db, backup); err == nil {
+		t.Error("Existing backup was overwritten")
+	}
+
+	dbFile := filepath.Join(dir, "db.sqlite")
+	ioutil.WriteFile(dbFile, []byte("previous"), 0600)
+
+	if err := restoreDatabase(dbFile, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := OpenDB(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if devices, _ := restored.ListDevices(); len(devices) != len(gTestDevices) {
+		t.Errorf("Unexpected devices in restored database: %#v", devices)
+	}
+	restored.Close()
+
+	if previous, _ := ioutil.ReadFile(dbFile + ".before-restore"); string(previous) != "previous" {
+		t.Error("Previous database wasn't kept")
+	}
+}
+
+func TestRestoreRunningDatabase(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	dir, cleanupDir := tempBackupDir(t)
+	defer cleanupDir()
+
+	backup := filepath.Join(dir, "backup.sqlite")
+	if _, err := backupDatabase(db, backup); err != nil {
+		t.Fatal(err)
+	}
+
+	dbFile := filepath.Join(dir, "db.sqlite")
+	ioutil.WriteFile(dbFile, []byte("current"), 0600)
+
+	// As the server does while serving
+	lock, err := lockDatabase(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreDatabase(dbFile, backup); err == nil {
+		t.Error("Database was restored while in use")
+	}
+
+	if current, _ := ioutil.ReadFile(dbFile); string(current) != "current" {
+		t.Error("Database in use was replaced")
+	}
+
+	lock.Close()
+	if err := restoreDatabase(dbFile, backup); err != nil {
+		t.Errorf("Failed to restore once the lock was released: %s", err)
+	}
+}
+
+func TestRestoreValidation(t *testing.T) {
+	dir, cleanupDir := tempBackupDir(t)
+	defer cleanupDir()
+
+	dbFile := filepath.Join(dir, "db.sqlite")
+	ioutil.WriteFile(dbFile, []byte("current"), 0600)
+
+	garbage := filepath.Join(dir, "garbage.sqlite")
+	ioutil.WriteFile(garbage, []byte("not a database"), 0600)
+
+	other := filepath.Join(dir, "other.sqlite")
+	conn, _ := sql.Open(timedSQLiteDriver, other)
+	conn.Exec(`create table something (id integer)`)
+	conn.Close()
+
+	newer := filepath.Join(dir, "newer.sqlite")
+	db, err := OpenDB(newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.connection.Exec(`pragma user_version = 1000`)
+	db.Close()
+
+	for _, backup := range []string{garbage, other, newer, filepath.Join(dir, "missing")} {
+		if err := restoreDatabase(dbFile, backup); err == nil {
+			t.Errorf("%s was restored", backup)
+		}
+	}
+
+	if current, _ := ioutil.ReadFile(dbFile); string(current) != "current" {
+		t.Error("Database was replaced by an invalid backup")
+	}
+}
+
+func TestServeBackup(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+	gDB = db
+	defer func() { gDB = nil }()
+
+	dir, cleanupDir := tempBackupDir(t)
+	defer cleanupDir()
+
+	gServerConfig = defaultConfig()
+	gServerConfig.BackupDir = dir
+	defer func() { gServerConfig = ServerConfig{} }()
+
+	response := httptest.NewRecorder()
+	serveBackup(response, httptest.NewRequest("POST", "/admin/backup", nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Backup endpoint is enabled without a token: %d", response.Code)
+	}
+
+	gServerConfig.AdminToken = strings.Repeat("t", 32)
+
+	for _, token := range []string{"", "Bearer wrong"} {
+		request := httptest.NewRequest("POST", "/admin/backup", nil)
+		request.Header.Set("Authorization", token)
+
+		response = httptest.NewRecorder()
+		serveBackup(response, request)
+		if response.Code != http.StatusUnauthorized {
+			t.Errorf("Unexpected response code for %q: %d", token, response.Code)
+		}
+	}
+
+	request := httptest.NewRequest("POST", "/admin/backup", nil)
+	request.Header.Set("Authorization", "Bearer "+gServerConfig.AdminToken)
+
+	response = httptest.NewRecorder()
+	serveBackup(response, request)
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	info := BackupInfo{}
+	json.Unmarshal(response.Body.Bytes(), &info)
+	if _, err := os.Stat(info.File); err != nil || filepath.Dir(info.File) != dir {
+		t.Errorf("Unexpected backup: %#v, %v", info, err)
+	}
+}
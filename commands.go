@@ -17,7 +17,7 @@ func populateCommandsDB(db *DB, commandsFile string) error {
 	}
 
 	for _, cmd := range commands {
-		_, err = db.AddCommand(cmd.Id, cmd.Name, cmd.Description)
+		_, err = db.AddCommand(cmd.Id, cmd.Name, cmd.Description, cmd.Destructive)
 		if err != nil {
 			return err
 		}
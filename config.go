@@ -2,9 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
-	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 type ServerConfig struct {
@@ -16,25 +26,428 @@ type ServerConfig struct {
 	KeyFilename   string `json:"keyFilename"`
 	SessionCookie string `json:"sessionCookie"`
 	PackagePath   string `json:"-"`
+
+	SessionCookieOptions CookieOptions `json:"sessionCookieOptions"`
+
+	// Previous values of SessionCookie, whose cookies are still accepted
+	// so that the key can be changed without logging everyone out.
+	SessionCookieOldKeys []string `json:"sessionCookieOldKeys"`
+
+	// Sessions end once unused for SessionIdleHours, or SessionMaxAgeHours
+	// after logging in, whichever comes first.
+	SessionIdleHours   int `json:"sessionIdleHours"`
+	SessionMaxAgeHours int `json:"sessionMaxAgeHours"`
+
+	LocationRetention          RetentionPolicy            `json:"locationRetention"`
+	LocationRetentionOverrides map[string]RetentionPolicy `json:"locationRetentionOverrides"`
+
+	// Base64 encoded 32 byte keys used to encrypt coordinates and push
+	// endpoints, by key id. Keys can also be read from a JSON file with
+	// the same format. New values are encrypted with EncryptionKeyId.
+	EncryptionKeys    map[string]string `json:"encryptionKeys"`
+	EncryptionKeyFile string            `json:"encryptionKeyFile"`
+	EncryptionKeyId   string            `json:"encryptionKeyId"`
+
+	// Certificates for ACMEDomains are obtained and renewed from an ACME
+	// server, Let's Encrypt unless ACMEDirectoryURL is set, and kept in
+	// ACMECacheDir. Otherwise CertFilename and KeyFilename are used, and
+	// read again when they change.
+	ACMEDomains      []string `json:"acmeDomains"`
+	ACMEEmail        string   `json:"acmeEmail"`
+	ACMECacheDir     string   `json:"acmeCacheDir"`
+	ACMEDirectoryURL string   `json:"acmeDirectoryURL"`
+
+	// Plain HTTP port redirecting to the TLS port, and answering ACME
+	// challenges. Empty disables it.
+	RedirectPort string `json:"redirectPort"`
+
+	// Serving plain HTTP is refused on anything but a loopback address
+	// unless this is set.
+	InsecureHTTP bool `json:"insecureHTTP"`
+
+	// One of debug, info, warn or error, and json or text.
+	LogLevel  string `json:"logLevel"`
+	LogFormat string `json:"logFormat"`
+
+	// Token buckets by route class (api, command, location or pairing),
+	// each applied per user, per device and per IP address.
+	RateLimits map[string]RateLimit `json:"rateLimits"`
+
+	// Backups are taken into BackupDir every BackupIntervalHours, if set,
+	// and on request. Only the BackupRetain most recent ones are kept,
+	// or all of them if zero.
+	BackupDir           string `json:"backupDir"`
+	BackupCompress      bool   `json:"backupCompress"`
+	BackupRetain        int    `json:"backupRetain"`
+	BackupIntervalHours int    `json:"backupIntervalHours"`
+
+	// Account exports too large to send right away are written to
+	// ExportDir, and deleted after ExportRetentionHours.
+	ExportDir            string `json:"exportDir"`
+	ExportRetentionHours int    `json:"exportRetentionHours"`
+
+	// Reported locations are given an address by Geocoder, offline or
+	// nominatim, or not at all if empty. The offline one reads a GeoNames
+	// cities file, the bundled one unless GeocoderDataset is set.
+	Geocoder        string `json:"geocoder"`
+	GeocoderDataset string `json:"geocoderDataset"`
+	NominatimURL    string `json:"nominatimURL"`
+
+	// Bearer token for the /admin endpoints, which are disabled when it
+	// is empty.
+	AdminToken string `json:"adminToken"`
+}
+
+// How long location history is kept. Fixes older than Days are deleted,
+// and fixes older than DownsampleDays are thinned out to one per hour.
+// Zero disables either step.
+type RetentionPolicy struct {
+	Days           int `json:"days"`
+	DownsampleDays int `json:"downsampleDays"`
+}
+
+// Attributes of the session cookie. SameSite is one of lax, strict or
+// none, the latter requiring Secure.
+type CookieOptions struct {
+	SameSite string `json:"sameSite"`
+	Secure   bool   `json:"secure"`
+	HttpOnly bool   `json:"httpOnly"`
+}
+
+var cookieSameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func (self CookieOptions) sameSiteMode() http.SameSite {
+	if mode, exists := cookieSameSiteModes[strings.ToLower(self.SameSite)]; exists {
+		return mode
+	}
+	return http.SameSiteDefaultMode
 }
 
 var gServerConfig ServerConfig
 
-func readConfig(file string) {
+const configEnvPrefix = "WHEREISMYFOX_"
 
-	var data []byte
-	var err error
+func defaultConfig() ServerConfig {
+	return ServerConfig{
+		Hostname:     "localhost",
+		Port:         "8080",
+		PersonaName:  "whereismyfox.com:80",
+		ACMECacheDir: "acme-cache",
+		BackupDir:    "backups",
+		BackupRetain: 7,
+		ExportDir:    "exports",
+		LogLevel:     "info",
+		LogFormat:    "json",
+		NominatimURL: "https://nominatim.openstreetmap.org",
+		SessionCookieOptions: CookieOptions{
+			SameSite: "lax",
+			HttpOnly: true,
+		},
+		SessionIdleHours:     7 * 24,
+		SessionMaxAgeHours:   30 * 24,
+		ExportRetentionHours: 24,
+		RateLimits: map[string]RateLimit{
+			rateLimitAPI:      {PerMinute: 600, Burst: 100},
+			rateLimitCommand:  {PerMinute: 10, Burst: 5},
+			rateLimitLocation: {PerMinute: 60, Burst: 30},
+			rateLimitPairing:  {PerMinute: 5, Burst: 5},
+		},
+	}
+}
+
+// configFields maps the name of every configurable field, as used in
+// configuration files, to its index in ServerConfig.
+func configFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(ServerConfig{})
+
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+
+	return fields
+}
 
-	data, err = ioutil.ReadFile(file)
+// configEnvName turns a field name like personaHostName into the
+// environment variable WHEREISMYFOX_PERSONA_HOST_NAME.
+func configEnvName(field string) string {
+	name := ""
+	for i, r := range field {
+		if i > 0 && unicode.IsUpper(r) && unicode.IsLower(rune(field[i-1])) {
+			name += "_"
+		}
+		name += string(unicode.ToUpper(r))
+	}
+	return configEnvPrefix + name
+}
+
+// readConfigFile merges the file into config. The format is picked from
+// the extension, and defaults to JSON. TOML and YAML documents use the
+// same field names as JSON ones.
+func readConfigFile(file string, config *ServerConfig) error {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Println("Not configured.  Could not find config.json")
-		os.Exit(-1)
+		return err
+	}
+
+	var values map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return json.Unmarshal(data, config)
 	}
 
-	err = json.Unmarshal(data, &gServerConfig)
 	if err != nil {
-		log.Println("Could not unmarshal config.json", err)
-		os.Exit(-1)
-		return
+		return err
+	}
+
+	if data, err = json.Marshal(values); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, config)
+}
+
+// applyConfigOverrides sets fields from their textual value. Strings are
+// taken as is, and anything else is parsed as JSON, so that for example
+// locationRetention can be given as {"days": 30}.
+func applyConfigOverrides(config *ServerConfig, overrides map[string]string) error {
+	fields := configFields()
+	v := reflect.ValueOf(config).Elem()
+
+	for name, value := range overrides {
+		i, exists := fields[name]
+		if !exists {
+			return fmt.Errorf("Unknown configuration field %s", name)
+		}
+
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func configEnvOverrides(environ []string) map[string]string {
+	names := map[string]string{}
+	for field := range configFields() {
+		names[configEnvName(field)] = field
+	}
+
+	overrides := map[string]string{}
+	for _, env := range environ {
+		parts := strings.SplitN(env, "=", 2)
+		if field, exists := names[parts[0]]; exists && len(parts) == 2 {
+			overrides[field] = parts[1]
+		}
+	}
+
+	return overrides
+}
+
+// configFlag collects configuration fields given on the command line.
+type configFlag struct {
+	name      string
+	overrides map[string]string
+}
+
+func (self configFlag) String() string {
+	return ""
+}
+
+func (self configFlag) Set(value string) error {
+	self.overrides[self.name] = value
+	return nil
+}
+
+// registerConfigFlags adds a flag for every configuration field, named
+// after the field. The returned map is filled with the flags that are
+// set once the flag set is parsed.
+func registerConfigFlags(fs *flag.FlagSet) map[string]string {
+	overrides := map[string]string{}
+	for name := range configFields() {
+		fs.Var(configFlag{name, overrides}, name, "Overrides "+name+" from the configuration file")
+	}
+	return overrides
+}
+
+// loadConfig resolves the configuration from, in increasing order of
+// precedence: built-in defaults, the configuration file (if any),
+// WHEREISMYFOX_* environment variables and command line flags.
+func loadConfig(file string, environ []string, flagOverrides map[string]string) (ServerConfig, error) {
+	config := defaultConfig()
+
+	if file != "" {
+		if err := readConfigFile(file, &config); err != nil {
+			return config, fmt.Errorf("Could not read %s: %s", file, err)
+		}
+	}
+
+	if err := applyConfigOverrides(&config, configEnvOverrides(environ)); err != nil {
+		return config, err
+	}
+
+	if err := applyConfigOverrides(&config, flagOverrides); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// Validate reports every problem with the configuration, rather than
+// stopping at the first one.
+func (self ServerConfig) Validate() []error {
+	errors := []error{}
+
+	if port, err := strconv.Atoi(self.Port); err != nil || port < 1 || port > 65535 {
+		errors = append(errors, fmt.Errorf("port %q is not a valid port number", self.Port))
+	}
+
+	if self.PersonaName == "" {
+		errors = append(errors, fmt.Errorf("personaHostName is not set"))
+	}
+
+	if self.SessionCookie == "" || self.SessionCookie == "changeme" {
+		errors = append(errors, fmt.Errorf("sessionCookie must be set to a secret value"))
+	}
+
+	for _, key := range self.SessionCookieOldKeys {
+		if key == "" || key == self.SessionCookie {
+			errors = append(errors, fmt.Errorf("sessionCookieOldKeys can't be empty or the current sessionCookie"))
+			break
+		}
+	}
+
+	if self.SessionIdleHours < 1 || self.SessionMaxAgeHours < 1 {
+		errors = append(errors, fmt.Errorf("sessionIdleHours and sessionMaxAgeHours must be at least 1"))
+	} else if self.SessionIdleHours > self.SessionMaxAgeHours {
+		errors = append(errors, fmt.Errorf("sessionIdleHours can't be longer than sessionMaxAgeHours"))
 	}
+
+	cookie := self.SessionCookieOptions
+	if _, exists := cookieSameSiteModes[strings.ToLower(cookie.SameSite)]; !exists {
+		errors = append(errors, fmt.Errorf("sessionCookieOptions sameSite %q is not one of lax, strict or none", cookie.SameSite))
+	} else if strings.ToLower(cookie.SameSite) == "none" && !cookie.Secure {
+		errors = append(errors, fmt.Errorf("sessionCookieOptions sameSite none requires secure"))
+	}
+
+	if cookie.Secure && !self.UseTLS && !isLoopback(self.Hostname) {
+		errors = append(errors, fmt.Errorf("sessionCookieOptions secure requires useTLS"))
+	}
+
+	if self.UseTLS && len(self.ACMEDomains) == 0 {
+		files := map[string]string{
+			"certFilename": self.CertFilename,
+			"keyFilename":  self.KeyFilename,
+		}
+
+		for name, file := range files {
+			if file == "" {
+				errors = append(errors, fmt.Errorf("%s is required when useTLS is set without acmeDomains", name))
+			} else if _, err := os.Stat(file); err != nil {
+				errors = append(errors, fmt.Errorf("%s: %s", name, err))
+			}
+		}
+	}
+
+	if len(self.ACMEDomains) != 0 && !self.UseTLS {
+		errors = append(errors, fmt.Errorf("acmeDomains requires useTLS"))
+	}
+
+	if !self.UseTLS && !self.InsecureHTTP && !isLoopback(self.Hostname) {
+		errors = append(errors, fmt.Errorf("useTLS is not set, set insecureHTTP to serve plain HTTP on %s", self.Hostname))
+	}
+
+	if self.RedirectPort != "" {
+		if port, err := strconv.Atoi(self.RedirectPort); err != nil || port < 1 || port > 65535 {
+			errors = append(errors, fmt.Errorf("redirectPort %q is not a valid port number", self.RedirectPort))
+		} else if !self.UseTLS {
+			errors = append(errors, fmt.Errorf("redirectPort requires useTLS"))
+		}
+	}
+
+	policies := map[string]RetentionPolicy{"": self.LocationRetention}
+	for user, policy := range self.LocationRetentionOverrides {
+		policies[user] = policy
+	}
+
+	for user, policy := range policies {
+		if policy.Days < 0 || policy.DownsampleDays < 0 {
+			name := "locationRetention"
+			if user != "" {
+				name = "locationRetentionOverrides for " + user
+			}
+			errors = append(errors, fmt.Errorf("%s can't have negative days", name))
+		}
+	}
+
+	for class, limit := range self.RateLimits {
+		known := false
+		for _, c := range rateLimitClasses {
+			known = known || c == class
+		}
+
+		if !known {
+			errors = append(errors, fmt.Errorf("rateLimits has unknown route class %q", class))
+		} else if err := limit.validate(class); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if self.BackupRetain < 0 || self.BackupIntervalHours < 0 {
+		errors = append(errors, fmt.Errorf("backupRetain and backupIntervalHours can't be negative"))
+	}
+
+	if self.BackupDir == "" {
+		errors = append(errors, fmt.Errorf("backupDir is not set"))
+	}
+
+	if self.ExportDir == "" {
+		errors = append(errors, fmt.Errorf("exportDir is not set"))
+	}
+
+	if self.ExportRetentionHours < 1 {
+		errors = append(errors, fmt.Errorf("exportRetentionHours must be at least 1"))
+	}
+
+	switch self.Geocoder {
+	case "", GeocoderOffline:
+	case GeocoderNominatim:
+		if u, err := url.Parse(self.NominatimURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errors = append(errors, fmt.Errorf("nominatimURL %q is not a valid URL", self.NominatimURL))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("geocoder must be %s or %s", GeocoderOffline, GeocoderNominatim))
+	}
+
+	if self.AdminToken != "" && len(self.AdminToken) < 32 {
+		errors = append(errors, fmt.Errorf("adminToken must be at least 32 characters"))
+	}
+
+	if _, err := newLogger(ioutil.Discard, self.LogLevel, self.LogFormat); err != nil {
+		errors = append(errors, err)
+	}
+
+	if _, err := loadFieldCipher(self); err != nil {
+		errors = append(errors, err)
+	}
+
+	return errors
 }
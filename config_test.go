@@ -0,0 +1,165 @@
+package main
+
+import "flag"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func writeConfigFile(t *testing.T, name, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "whereismyfoxconfig")
+	if err != nil {
+		panic(err)
+	}
+
+	file := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		panic(err)
+	}
+
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{"port": "9000", "useTLS": true, "locationRetention": {"days": 30}}`,
+		"config.toml": "port = \"9000\"\nuseTLS = true\n[locationRetention]\ndays = 30\n",
+		"config.yaml": "port: \"9000\"\nuseTLS: true\nlocationRetention:\n  days: 30\n",
+	}
+
+	for name, contents := range files {
+		file, cleanup := writeConfigFile(t, name, contents)
+		defer cleanup()
+
+		config, err := loadConfig(file, nil, nil)
+		if err != nil {
+			t.Errorf("Failed to load %s: %s", name, err)
+			continue
+		}
+
+		if config.Port != "9000" || !config.UseTLS || config.LocationRetention.Days != 30 {
+			t.Errorf("Unexpected configuration from %s: %#v", name, config)
+		}
+
+		// Defaults are kept for fields missing from the file
+		if config.Hostname != "localhost" {
+			t.Errorf("Default hostname was lost reading %s: %#v", name, config)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file, cleanup := writeConfigFile(t, "config.json",
+		`{"hostname": "file", "port": "9000", "sessionCookie": "file"}`)
+	defer cleanup()
+
+	environ := []string{
+		"WHEREISMYFOX_PORT=9001",
+		"WHEREISMYFOX_SESSION_COOKIE=env",
+		"WHEREISMYFOX_USE_TLS=true",
+		`WHEREISMYFOX_LOCATION_RETENTION={"days": 10}`,
+		"PORT=1",
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := registerConfigFlags(fs)
+	if err := fs.Parse([]string{"-sessionCookie", "flag"}); err != nil {
+		t.Fatal("Failed to parse flags: " + err.Error())
+	}
+
+	config, err := loadConfig(file, environ, overrides)
+	if err != nil {
+		t.Fatal("Failed to load configuration: " + err.Error())
+	}
+
+	if config.Hostname != "file" || config.Port != "9001" ||
+		config.SessionCookie != "flag" || !config.UseTLS ||
+		config.LocationRetention.Days != 10 {
+		t.Errorf("Unexpected configuration: %#v", config)
+	}
+
+	_, err = loadConfig(file, []string{"WHEREISMYFOX_USE_TLS=maybe"}, nil)
+	if err == nil {
+		t.Errorf("Invalid environment variable was accepted")
+	}
+}
+
+func TestConfigEnvName(t *testing.T) {
+	names := map[string]string{
+		"port":            "WHEREISMYFOX_PORT",
+		"personaHostName": "WHEREISMYFOX_PERSONA_HOST_NAME",
+		"useTLS":          "WHEREISMYFOX_USE_TLS",
+		"encryptionKeyId": "WHEREISMYFOX_ENCRYPTION_KEY_ID",
+	}
+
+	for field, expected := range names {
+		if name := configEnvName(field); name != expected {
+			t.Errorf("Unexpected environment variable for %s: %s", field, name)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := defaultConfig()
+	config.SessionCookie = "s3cr3t"
+	if problems := config.Validate(); len(problems) != 0 {
+		t.Errorf("Unexpected problems with a valid configuration: %v", problems)
+	}
+
+	config.Port = "80800"
+	config.SessionCookie = "changeme"
+	config.UseTLS = true
+	config.CertFilename = "/nonexistent/cert.pem"
+	config.LocationRetention.Days = -1
+	config.SessionCookieOptions.SameSite = "none"
+	config.Geocoder = "google"
+	config.RateLimits = map[string]RateLimit{
+		rateLimitCommand: {PerMinute: 10},
+		"everything":     {PerMinute: 10, Burst: 1},
+	}
+
+	problems := config.Validate()
+	expected := []string{"port", "sessionCookie", "certFilename", "keyFilename", "locationRetention",
+		"rateLimits for command", "everything", "sameSite none", "geocoder"}
+	if len(problems) != len(expected) {
+		t.Errorf("Unexpected problems: %v", problems)
+	}
+
+	for _, name := range expected {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.Contains(problem.Error(), name)
+		}
+
+		if !found {
+			t.Errorf("Problem with %s was not reported: %v", name, problems)
+		}
+	}
+
+	config = defaultConfig()
+	config.SessionCookie = "s3cr3t"
+	config.Hostname = "example.com"
+	if problems := config.Validate(); len(problems) != 1 {
+		t.Errorf("Plain HTTP was allowed on a public address: %v", problems)
+	}
+
+	config.InsecureHTTP = true
+	if problems := config.Validate(); len(problems) != 0 {
+		t.Errorf("Unexpected problems with insecureHTTP: %v", problems)
+	}
+
+	// ACME doesn't need certificate files
+	config.UseTLS = true
+	config.ACMEDomains = []string{"example.com"}
+	config.RedirectPort = "8080"
+	if problems := config.Validate(); len(problems) != 0 {
+		t.Errorf("Unexpected problems with ACME: %v", problems)
+	}
+
+	config.Geocoder = GeocoderNominatim
+	config.NominatimURL = "nominatim.example.com"
+	if problems := config.Validate(); len(problems) != 1 {
+		t.Errorf("Invalid nominatimURL was allowed: %v", problems)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Commands flagged as destructive in the catalog are not pushed right
+// away. Instead, a pending confirmation is created and the command is
+// only pushed once the same user confirms it, with a TOTP code if they
+// have enrolled one. Deleting an account is confirmed the same way, with
+// no device.
+const (
+	confirmationLifetime    = 5 * time.Minute
+	confirmationMaxAttempts = 3
+)
+
+type PendingConfirmation struct {
+	Id       string
+	User     string
+	DeviceId int64
+	Command  string
+	Context  CommandContext
+	Expires  time.Time
+	Attempts int
+}
+
+type ConfirmationResponse struct {
+	Id           string `json:"id"`
+	Confirm      string `json:"confirm"`
+	Expires      int64  `json:"expires"`
+	TOTPRequired bool   `json:"totpRequired"`
+}
+
+type ConfirmationRequest struct {
+	Code string `json:"code"`
+}
+
+var gConfirmations = map[string]*PendingConfirmation{}
+var gConfirmationsLock sync.Mutex
+
+func newConfirmation(user string, deviceId int64, command string, context CommandContext) (*PendingConfirmation, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	pending := &PendingConfirmation{
+		Id:       hex.EncodeToString(id),
+		User:     user,
+		DeviceId: deviceId,
+		Command:  command,
+		Context:  context,
+		Expires:  time.Now().Add(confirmationLifetime),
+	}
+
+	gConfirmationsLock.Lock()
+	defer gConfirmationsLock.Unlock()
+
+	now := time.Now()
+	for id, c := range gConfirmations {
+		if now.After(c.Expires) {
+			delete(gConfirmations, id)
+		}
+	}
+
+	gConfirmations[pending.Id] = pending
+	return pending, nil
+}
+
+// lookupConfirmation only returns confirmations that haven't expired and
+// that were requested by the same user for the same device.
+func lookupConfirmation(id, user string, deviceId int64) *PendingConfirmation {
+	gConfirmationsLock.Lock()
+	defer gConfirmationsLock.Unlock()
+
+	pending, exists := gConfirmations[id]
+	if !exists {
+		return nil
+	}
+
+	if time.Now().After(pending.Expires) {
+		delete(gConfirmations, id)
+		return nil
+	}
+
+	if pending.User != user || pending.DeviceId != deviceId {
+		return nil
+	}
+
+	return pending
+}
+
+// failConfirmation counts a failed attempt, discarding the confirmation
+// once too many codes were wrong.
+func failConfirmation(pending *PendingConfirmation) {
+	gConfirmationsLock.Lock()
+	defer gConfirmationsLock.Unlock()
+
+	pending.Attempts++
+	if pending.Attempts >= confirmationMaxAttempts {
+		delete(gConfirmations, pending.Id)
+	}
+}
+
+func removeConfirmation(pending *PendingConfirmation) bool {
+	gConfirmationsLock.Lock()
+	defer gConfirmationsLock.Unlock()
+
+	if _, exists := gConfirmations[pending.Id]; !exists {
+		return false
+	}
+
+	delete(gConfirmations, pending.Id)
+	return true
+}
+
+// removeConfirmationsForUser discards every confirmation the user
+// requested.
+func removeConfirmationsForUser(user string) {
+	gConfirmationsLock.Lock()
+	defer gConfirmationsLock.Unlock()
+
+	for id, c := range gConfirmations {
+		if c.User == user {
+			delete(gConfirmations, id)
+		}
+	}
+}
+
+func requestConfirmation(request *restful.Request, response *restful.Response, device *Device, command *Command, context CommandContext) {
+	user := gPersona.GetLoginName(request.Request)
+
+	secret, err := gDB.GetTOTPSecret(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to request confirmation")
+		return
+	}
+
+	pending, err := newConfirmation(user, device.Id, command.Name, context)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to request confirmation")
+		return
+	}
+
+	audit(request, device.Id, AuditCommand, command.Name, context.Arguments, "confirmation pending")
+
+	response.WriteHeaderAndEntity(http.StatusAccepted, ConfirmationResponse{
+		Id:           pending.Id,
+		Confirm:      fmt.Sprintf("%s/device/%d/confirm/%s", apiRoot(request), device.Id, pending.Id),
+		Expires:      pending.Expires.Unix(),
+		TOTPRequired: secret != "",
+	})
+}
+
+func confirmCommand(request *restful.Request, response *restful.Response) {
+	device := getDeviceForRequest(request, response)
+	if device == nil {
+		return
+	}
+
+	user := gPersona.GetLoginName(request.Request)
+	pending := lookupConfirmation(request.PathParameter("confirmation-id"), user, device.Id)
+	if pending == nil {
+		writeError(request, response, http.StatusNotFound, ErrConfirmationNotFound, "Confirmation not found")
+		return
+	}
+
+	confirmation := ConfirmationRequest{}
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(&confirmation); err != nil {
+			writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse confirmation")
+			return
+		}
+	}
+
+	secret, err := gDB.GetTOTPSecret(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to confirm command")
+		return
+	}
+
+	if secret != "" && !validateTOTP(secret, confirmation.Code, time.Now()) {
+		failConfirmation(pending)
+		audit(request, device.Id, AuditCommand, pending.Command, pending.Context.Arguments, "invalid confirmation code")
+		writeError(request, response, http.StatusForbidden, ErrInvalidCode, "Invalid confirmation code")
+		return
+	}
+
+	// Someone else may have confirmed concurrently
+	if !removeConfirmation(pending) {
+		writeError(request, response, http.StatusNotFound, ErrConfirmationNotFound, "Confirmation not found")
+		return
+	}
+
+	if err = pushCommand(request.Request.Context(), device, pending.Context); err != nil {
+		audit(request, device.Id, AuditCommand, pending.Command, pending.Context.Arguments, "push failed")
+		writeError(request, response, legacyStatus(request, http.StatusBadGateway, http.StatusInternalServerError),
+			ErrPushFailed, "Failed to push command")
+		return
+	}
+
+	audit(request, device.Id, AuditCommand, pending.Command, pending.Context.Arguments, "pushed")
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// FieldCipher encrypts individual database fields with AES-256-GCM.
+// Encrypted values look like "enc2:<key id>:<base64 nonce and ciphertext>",
+// so values sealed with an older key can still be opened after rotating
+// to a new one, and plaintext values written before encryption was
+// enabled are still readable. So are values sealed by earlier releases,
+// prefixed with "enc:", until -reencrypt seals them again.
+type FieldCipher struct {
+	keys    map[string]cipher.AEAD
+	current string
+
+	// Keys for hashing fields, derived from the encryption keys, by id
+	indexKeys map[string][]byte
+}
+
+const encryptedPrefix = "enc2:"
+
+// Values sealed with only the field name as additional data
+const legacyEncryptedPrefix = "enc:"
+
+// Hashes of fields stored in plaintext are prefixed with this instead of
+// a key id.
+const plainIndexPrefix = "sha256:"
+
+func NewFieldCipher(keys map[string][]byte, current string) (*FieldCipher, error) {
+	if _, exists := keys[current]; !exists {
+		return nil, fmt.Errorf("Unknown encryption key id %q", current)
+	}
+
+	c := &FieldCipher{map[string]cipher.AEAD{}, current, map[string][]byte{}}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("Invalid encryption key id %q", id)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Encryption key %q must be 32 bytes long", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if c.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("whereismyfox field index"))
+		c.indexKeys[id] = mac.Sum(nil)
+	}
+
+	return c, nil
+}
+
+// The field name and the row the value belongs to, e.g. "device 12",
+// are used as additional data, so a value can't be moved to another
+// column or row and still be opened.
+func (self *FieldCipher) Seal(field, row, plaintext string) (string, error) {
+	aead := self.keys[self.current]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(field+"|"+row))
+	return encryptedPrefix + self.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (self *FieldCipher) Open(field, row, value string) (string, error) {
+	prefix, additional := encryptedPrefix, field+"|"+row
+	if strings.HasPrefix(value, legacyEncryptedPrefix) {
+		prefix, additional = legacyEncryptedPrefix, field
+	} else if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, prefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Malformed encrypted %s", field)
+	}
+
+	if self == nil {
+		return "", fmt.Errorf("Found encrypted %s but no encryption keys are configured", field)
+	}
+
+	aead, exists := self.keys[parts[0]]
+	if !exists {
+		return "", fmt.Errorf("Unknown encryption key id %q for %s", parts[0], field)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("Malformed encrypted %s", field)
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], []byte(additional))
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt %s: %s", field, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Index is a keyed hash of a field, with the key id, for finding values or
+// keeping them unique, which sealing with a random nonce prevents.
+func (self *FieldCipher) Index(id, field, value string) string {
+	mac := hmac.New(sha256.New, self.indexKeys[id])
+	mac.Write([]byte(field + ":" + value))
+	return id + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NeedsReencryption is true for values stored in plaintext, sealed by an
+// earlier release, or sealed with a key other than the current one.
+func (self *FieldCipher) NeedsReencryption(value string) bool {
+	return !strings.HasPrefix(value, encryptedPrefix+self.current+":")
+}
+
+// loadFieldCipher builds the cipher from the keys in the configuration
+// and in the key file, if any. Without keys, fields are stored in
+// plaintext and a nil cipher is returned.
+func loadFieldCipher(config ServerConfig) (*FieldCipher, error) {
+	encoded := map[string]string{}
+	for id, key := range config.EncryptionKeys {
+		encoded[id] = key
+	}
+
+	if config.EncryptionKeyFile != "" {
+		data, err := ioutil.ReadFile(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		fileKeys := map[string]string{}
+		if err = json.Unmarshal(data, &fileKeys); err != nil {
+			return nil, fmt.Errorf("Could not unmarshal %s: %s", config.EncryptionKeyFile, err)
+		}
+
+		for id, key := range fileKeys {
+			encoded[id] = key
+		}
+	}
+
+	if len(encoded) == 0 {
+		return nil, nil
+	}
+
+	keys := map[string][]byte{}
+	for id, key := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("Encryption key %q is not valid base64", id)
+		}
+		keys[id] = decoded
+	}
+
+	current := config.EncryptionKeyId
+	if current == "" && len(keys) == 1 {
+		for id := range keys {
+			current = id
+		}
+	}
+
+	return NewFieldCipher(keys, current)
+}
+
+// fieldIndexes returns every hash the field could be indexed under, the
+// one to store first. Values stored in plaintext don't need a keyed hash.
+func (self DB) fieldIndexes(field, value string) []string {
+	hash := sha256.Sum256([]byte(field + ":" + value))
+	plain := plainIndexPrefix + hex.EncodeToString(hash[:])
+	if self.cipher == nil {
+		return []string{plain}
+	}
+
+	indexes := []string{self.cipher.Index(self.cipher.current, field, value)}
+	for id := range self.cipher.keys {
+		if id != self.cipher.current {
+			indexes = append(indexes, self.cipher.Index(id, field, value))
+		}
+	}
+
+	return append(indexes, plain)
+}
+
+// keyedHash is a hash of the value which can't be computed without the
+// current key, or without the server's secret when fields aren't
+// encrypted, e.g. so that coordinates or login names can't be found by
+// hashing guesses.
+func (self DB) keyedHash(field, value string) string {
+	if self.cipher != nil {
+		return self.cipher.Index(self.cipher.current, field, value)
+	}
+
+	mac := hmac.New(sha256.New, []byte(gServerConfig.SessionCookie))
+	mac.Write([]byte(field + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Rows sealed values are bound to. Reencrypt builds the same strings in
+// SQL.
+func deviceRow(id int64) string {
+	return fmt.Sprintf("device %d", id)
+}
+
+func locationRow(deviceId, timestamp int64) string {
+	return fmt.Sprintf("device %d at %d", deviceId, timestamp)
+}
+
+func (self DB) sealString(field, row, value string) (string, error) {
+	if self.cipher == nil {
+		return value, nil
+	}
+	return self.cipher.Seal(field, row, value)
+}
+
+func (self DB) openString(field, row, value string) (string, error) {
+	return self.cipher.Open(field, row, value)
+}
+
+// resealString moves a sealed value to another row. Values stored in
+// plaintext are moved as they are.
+func (self DB) resealString(field, from, to, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) && !strings.HasPrefix(value, legacyEncryptedPrefix) {
+		return value, nil
+	}
+
+	plaintext, err := self.openString(field, from, value)
+	if err != nil {
+		return "", err
+	}
+	return self.cipher.Seal(field, to, plaintext)
+}
+
+// Coordinates are kept as floats when encryption is disabled, so that
+// databases stay usable with older versions.
+func (self DB) sealFloat(field, row string, value float64) (interface{}, error) {
+	if self.cipher == nil {
+		return value, nil
+	}
+	return self.cipher.Seal(field, row, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (self DB) openFloat(field, row, value string) (float64, error) {
+	plaintext, err := self.cipher.Open(field, row, value)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(plaintext, 64)
+}
+
+// Reencrypt seals every encrypted field again with the current key,
+// including fields still stored in plaintext. It returns the number of
+// rows that were updated.
+func (self DB) Reencrypt() (int, error) {
+	if self.cipher == nil {
+		return 0, fmt.Errorf("No encryption keys are configured")
+	}
+
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	// Rows are named as by deviceRow, locationRow and in the geocoding
+	// cache
+	tables := []struct {
+		table  string
+		row    string
+		fields []string
+	}{
+		{"devices", `'device ' || id`, []string{"endpoint", "latitude", "longitude", "address"}},
+		{"locations", `'device ' || device_id || ' at ' || timestamp`, []string{"latitude", "longitude", "address"}},
+		{"geocode_cache", `key`, []string{"address"}},
+	}
+
+	for _, t := range tables {
+		res, err := tx.Query(`select id, ` + t.row + `, ` + strings.Join(t.fields, ", ") + ` from ` + t.table)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		type row struct {
+			id     int64
+			name   string
+			values []string
+		}
+
+		rows := []row{}
+		for res.Next() {
+			r := row{values: make([]string, len(t.fields))}
+			dest := []interface{}{&r.id, &r.name}
+			for i := range r.values {
+				dest = append(dest, &r.values[i])
+			}
+
+			if err = res.Scan(dest...); err != nil {
+				res.Close()
+				tx.Rollback()
+				return 0, err
+			}
+			rows = append(rows, r)
+		}
+		res.Close()
+
+		for _, r := range rows {
+			stale := false
+			for _, value := range r.values {
+				stale = stale || self.cipher.NeedsReencryption(value)
+			}
+
+			if !stale {
+				continue
+			}
+
+			args := []interface{}{}
+			for i, field := range t.fields {
+				plaintext, err := self.cipher.Open(field, r.name, r.values[i])
+				if err == nil {
+					var sealed string
+					sealed, err = self.cipher.Seal(field, r.name, plaintext)
+					args = append(args, sealed)
+				}
+
+				if err != nil {
+					tx.Rollback()
+					return 0, fmt.Errorf("%s %d: %s", t.table, r.id, err)
+				}
+			}
+
+			_, err = tx.Exec(`update `+t.table+` set `+strings.Join(t.fields, "=?, ")+`=? where id=?`,
+				append(args, r.id)...)
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			updated++
+		}
+	}
+
+	return updated, tx.Commit()
+}
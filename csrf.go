@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+// Requests changing state must carry the CSRF token of their session, in
+// the X-CSRF-Token header or, for forms, the csrf_token field. Other
+// sites can make the browser send the session cookie, but can't read the
+// token. A session gets its token from GET /auth/csrf, before logging in,
+// and a new one when logging in.
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+type CSRFTokenResponse struct {
+	CSRFToken string `json:"csrfToken"`
+}
+
+func newCSRFToken() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// requestCSRFToken reads the token sent with the request. Only form
+// bodies are parsed, so that other bodies are left for the handlers.
+func requestCSRFToken(r *http.Request) string {
+	if token := r.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(csrfFormField)
+	}
+
+	return ""
+}
+
+func validCSRFToken(r *http.Request) bool {
+	expected := gPersona.GetCSRFToken(r)
+	token := requestCSRFToken(r)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// checkCSRF rejects requests with unsafe methods lacking the token of
+// their session. Devices authenticated by their token don't use cookies,
+// and so don't need one. Must come after ensureIsLoggedIn.
+func checkCSRF(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if !isSafeMethod(request.Request.Method) && tokenDevice(request) == nil && !validCSRFToken(request.Request) {
+		slog.WarnContext(request.Request.Context(), "csrf", "outcome", "rejected",
+			"method", request.Request.Method,
+			"path", request.Request.URL.Path,
+			"source_ip", sourceIP(request.Request))
+		writeError(request, response, http.StatusForbidden, ErrInvalidCSRFToken, "Missing or invalid CSRF token")
+		return
+	}
+
+	chain.ProcessFilter(request, response)
+}
+
+// withCSRFCheck is checkCSRF for the handlers under /auth, which only
+// accept POST requests.
+func withCSRFCheck(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !validCSRFToken(r) {
+			slog.WarnContext(r.Context(), "csrf", "outcome", "rejected",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"source_ip", sourceIP(r))
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeCSRFToken(w http.ResponseWriter, token string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(CSRFTokenResponse{token})
+}
+
+// serveCSRFToken returns the token of the session, starting one if
+// needed.
+func serveCSRFToken(w http.ResponseWriter, r *http.Request) {
+	writeCSRFToken(w, gPersona.IssueCSRFToken(w, r))
+}
@@ -0,0 +1,88 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+func TestCSRFProtection(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	post := func(url, contentType, body, token string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		if token != "" {
+			request.Header.Set(csrfHeader, token)
+		}
+
+		response := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(response, request)
+		return response
+	}
+
+	for _, token := range []string{"", "forged"} {
+		response := post("/api/v1/device/location/1", "application/x-www-form-urlencoded", "latitude=1&longitude=2", token)
+		if response.Code != http.StatusForbidden {
+			t.Errorf("Unexpected response code with token %q: %d", token, response.Code)
+		}
+
+		result := APIErrorResponse{}
+		json.Unmarshal(response.Body.Bytes(), &result)
+		if result.Error.Code != ErrInvalidCSRFToken {
+			t.Errorf("Unexpected error: %#v", result)
+		}
+	}
+
+	response := post("/api/v1/device/location/1", "application/x-www-form-urlencoded", "latitude=1&longitude=2&csrf_token="+testCSRFToken, "")
+	if response.Code != http.StatusOK {
+		t.Errorf("Token in form was refused: %d", response.Code)
+	}
+
+	if response := doNonWebServiceRequest("GET", "/api/v1/device/1", ""); response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code for GET: %d", response.Code)
+	}
+
+	if response := doNonWebServiceRequest("GET", "/auth/logout", ""); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Logging out with GET: %d", response.Code)
+	}
+
+	if response := post("/auth/login", "application/x-www-form-urlencoded", "assertion=x", ""); response.Code != http.StatusForbidden {
+		t.Errorf("Logging in without token: %d", response.Code)
+	}
+}
+
+func TestSessionCSRFToken(t *testing.T) {
+	config := defaultConfig()
+	config.SessionCookie = "s3cr3t"
+	config.SessionCookieOptions = CookieOptions{SameSite: "strict", HttpOnly: true}
+	persona := NewPersonaHandler(config)
+
+	request, _ := http.NewRequest("GET", "/auth/csrf", nil)
+	if token := persona.GetCSRFToken(request); token != "" {
+		t.Errorf("New session has a token: %q", token)
+	}
+
+	response := httptest.NewRecorder()
+	token := persona.IssueCSRFToken(response, request)
+
+	cookies := response.Result().Cookies()
+	if token == "" || len(cookies) != 1 {
+		t.Fatalf("Token %q wasn't saved: %v", token, cookies)
+	}
+
+	if !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode || cookies[0].Secure {
+		t.Errorf("Unexpected cookie attributes: %#v", cookies[0])
+	}
+
+	request, _ = http.NewRequest("GET", "/auth/csrf", nil)
+	request.AddCookie(cookies[0])
+	if got := persona.GetCSRFToken(request); got != token {
+		t.Errorf("Token wasn't kept in the session: %q != %q", got, token)
+	}
+
+	if again := persona.IssueCSRFToken(httptest.NewRecorder(), request); again != token {
+		t.Errorf("Token was replaced: %q != %q", again, token)
+	}
+}
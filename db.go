@@ -2,31 +2,218 @@ package main
 
 import (
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 )
 
 type Command struct {
-	Id          int64  `json: "id"`
-	Name        string `json: "name"`
-	Description string `json: "description"`
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Destructive bool   `json:"destructive"`
 }
 
 type Device struct {
-	User      string
-	Id        int64   `json: "id"`
-	Name      string  `json: "name"`
-	Endpoint  string  `json: "endpoint"`
-	Latitude  float64 `json: "latitude"`
-	Longitude float64 `json: "longitude"`
-	Timestamp string  `json: "timestamp"`
+	User      string  `json:"-"`
+	Id        int64   `json:"id"`
+	Name      string  `json:"name"`
+	Endpoint  string  `json:"endpoint"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timestamp string  `json:"timestamp"`
+
+	// Details of the last reported fix, see Location
+	Accuracy *float64 `json:"accuracy,omitempty"`
+	Altitude *float64 `json:"altitude,omitempty"`
+	Speed    *float64 `json:"speed,omitempty"`
+	Heading  *float64 `json:"heading,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Battery  *float64 `json:"battery,omitempty"`
+
+	// Of the current location, see Geocoder
+	Address string `json:"address,omitempty"`
 }
 
 type DB struct {
 	connection *sql.DB
+
+	// File the database was opened from
+	path string
+
+	// Encrypts coordinates and push endpoints, see FieldCipher. Fields
+	// are stored in plaintext when nil.
+	cipher *FieldCipher
+}
+
+// Schema changes applied, in order, on top of the tables created in
+// OpenDB. The number of migrations already applied to a database is
+// kept in its user_version pragma. Never edit or reorder these, only
+// append new ones.
+var migrations = []string{
+	`alter table devices add column accuracy float;
+	alter table devices add column altitude float;
+	alter table devices add column speed float;
+	alter table devices add column heading float;
+	alter table devices add column provider text default "";
+	alter table devices add column battery float;
+	create table locations
+	(id integer primary key autoincrement,
+	device_id integer references devices(id),
+	latitude float, longitude float, accuracy float, altitude float,
+	speed float, heading float, provider text default "", battery float,
+	timestamp integer, received integer);
+	create index locations_device_timestamp on locations(device_id, timestamp);`,
+
+	`create unique index locations_unique
+	on locations(device_id, timestamp, latitude, longitude);`,
+
+	// Encrypted coordinates can't be compared, so a device can only have
+	// one fix per second.
+	`delete from locations where id not in
+	(select min(id) from locations group by device_id, timestamp);
+	drop index locations_unique;
+	create unique index locations_unique on locations(device_id, timestamp);`,
+
+	`create table sessions
+	(id integer primary key autoincrement,
+	token_hash text unique, user text,
+	created integer, last_seen integer,
+	user_agent text default "", source_ip text default "");
+	create index sessions_user on sessions(user);`,
+
+	`create table invocations
+	(token integer primary key, device_id integer references devices(id),
+	command_id integer, arguments text default "null", created integer);`,
+
+	`create table exports
+	(id text primary key, user text, status text,
+	created integer, finished integer default 0, size integer default 0);
+	create index exports_user on exports(user);`,
+
+	// Tokens of paired devices, hashed like session tokens
+	`alter table devices add column token_hash text default "";
+	create index devices_token_hash on devices(token_hash);`,
+
+	// Addresses of fixes, and the answers of the geocoder by coordinates
+	`alter table locations add column address text default "";
+	alter table devices add column address text default "";
+	create table geocode_cache
+	(id integer primary key autoincrement,
+	key text unique, address text, created integer);`,
+
+	// Encrypted endpoints never compare equal, so their uniqueness is
+	// enforced on a keyed hash instead, see IndexEndpoints
+	`alter table devices add column endpoint_hash text;
+	create unique index devices_endpoint_hash on devices(endpoint_hash);`,
+
+	// Entries of deleted accounts are pseudonymised, which is the only
+	// change allowed to the audit log
+	`drop trigger audit_log_no_update;
+	create trigger audit_log_no_update
+	before update on audit_log
+	when new.actor!="" or new.source_ip!="" or new.arguments!=""
+	or new.id is not old.id or new.timestamp is not old.timestamp
+	or new.device_id is not old.device_id or new.action is not old.action
+	or new.command is not old.command or new.outcome is not old.outcome
+	begin select raise(abort, 'audit log is append-only'); end;`,
+
+	// Geocoding answers are kept for each user, to be deleted with their
+	// locations. It's only a cache, so the entries kept by coordinates
+	// alone are dropped.
+	`drop table geocode_cache;
+	create table geocode_cache
+	(id integer primary key autoincrement, user text,
+	key text unique, address text, created integer);
+	create index geocode_cache_user on geocode_cache(user);`,
+
+	// Releases before the catalog was kept across restarts recreated
+	// the commands table on startup.
+	`alter table commands add column destructive integer default 0;`,
+
+	// A trigger ignores fixes for a second already stored, instead of the
+	// unique index. Databases that ran an earlier version of migration 3
+	// kept their duplicate fixes, and already have the trigger.
+	`drop index if exists locations_unique;
+	create trigger if not exists locations_unique before insert on locations
+	when exists (select 1 from locations
+	where device_id=new.device_id and timestamp=new.timestamp)
+	begin select raise(ignore); end;`,
+}
+
+func migrate(conn *sql.DB) error {
+	var version int
+	if err := conn.QueryRow(`pragma user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(migrations[version]); err == nil {
+			_, err = tx.Exec(fmt.Sprintf(`pragma user_version = %d`, version+1))
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", version+1, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const deviceColumns = `id, user, name, endpoint, latitude, longitude, timestamp,
+	accuracy, altitude, speed, heading, provider, battery, address`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (self DB) scanDevice(row scanner) (*Device, error) {
+	d := Device{}
+	var endpoint, latitude, longitude, address string
+	err := row.Scan(
+		&d.Id, &d.User, &d.Name,
+		&endpoint, &latitude,
+		&longitude, &d.Timestamp,
+		&d.Accuracy, &d.Altitude, &d.Speed,
+		&d.Heading, &d.Provider, &d.Battery, &address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := deviceRow(d.Id)
+	if d.Endpoint, err = self.openString("endpoint", name, endpoint); err != nil {
+		return nil, err
+	}
+
+	if d.Latitude, err = self.openFloat("latitude", name, latitude); err != nil {
+		return nil, err
+	}
+
+	if d.Longitude, err = self.openFloat("longitude", name, longitude); err != nil {
+		return nil, err
+	}
+
+	if d.Address, err = self.openString("address", name, address); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
 }
 
 func OpenDB(dbpath string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", dbpath)
+	conn, err := sql.Open(timedSQLiteDriver, dbpath)
 	if err != nil {
 		return nil, err
 	}
@@ -42,15 +229,10 @@ func OpenDB(dbpath string) (*DB, error) {
 		return nil, err
 	}
 
+	// Commands are added or updated from commands.json on startup, and
+	// from the admin commands.
 	_, err = conn.Exec(
-		`drop table if exists commands`)
-
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = conn.Exec(
-		`create table commands
+		`create table if not exists commands
 		(id integer primary key, name text, description text,
 		unique (id, name, description))`)
 
@@ -72,7 +254,43 @@ func OpenDB(dbpath string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{conn}, nil
+	// The audit log is append-only: entries can never be removed once
+	// written, and only changed to forget who made them, see the
+	// migrations.
+	_, err = conn.Exec(
+		`create table if not exists audit_log
+		(id integer primary key autoincrement,
+		timestamp integer, actor text, device_id integer default 0,
+		action text, command text default "", arguments text default "",
+		source_ip text default "", outcome text default "");
+		create trigger if not exists audit_log_no_update
+		before update on audit_log
+		begin select raise(abort, 'audit log is append-only'); end;
+		create trigger if not exists audit_log_no_delete
+		before delete on audit_log
+		begin select raise(abort, 'audit log is append-only'); end;`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrate(conn); err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(
+		`create table if not exists totp_secrets
+		(user text primary key, secret text)`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{connection: conn, path: dbpath}, nil
+}
+
+func (self *DB) SetCipher(cipher *FieldCipher) {
+	self.cipher = cipher
 }
 
 func (self DB) Close() {
@@ -81,28 +299,125 @@ func (self DB) Close() {
 }
 
 func (self DB) AddDevice(user, name, endpoint string) (*Device, error) {
-	res, err := self.connection.Exec(
-		`insert into devices(user, name, endpoint) values(?, ?, ?)`,
-		user, name, endpoint)
+	// The endpoint may be indexed under an older key until IndexEndpoints
+	// runs again
+	indexes := self.fieldIndexes("endpoint", endpoint)
+	var count int
+	err := self.connection.QueryRow(
+		`select count(*) from devices where endpoint_hash in (?`+strings.Repeat(", ?", len(indexes)-1)+`)`,
+		stringArgs(indexes)...).Scan(&count)
+
+	if err != nil {
+		return nil, err
+	} else if count != 0 {
+		return nil, fmt.Errorf("Push endpoint is already registered")
+	}
+
+	// The endpoint is sealed for the device's id, known once inserted
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(
+		`insert into devices(user, name, endpoint, endpoint_hash) values(?, ?, "", ?)`,
+		user, name, indexes[0])
+
+	var id int64
+	var sealed string
+	if err == nil {
+		id, _ = res.LastInsertId()
+		sealed, err = self.sealString("endpoint", deviceRow(id), endpoint)
+	}
+
+	if err == nil {
+		_, err = tx.Exec(`update devices set endpoint=? where id=?`, sealed, id)
+	}
 
 	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
-	id, _ := res.LastInsertId()
 	return &Device{Id: id, Name: name, User: user, Endpoint: endpoint}, nil
 }
 
-func (self DB) AddCommand(id int64, name, description string) (*Command, error) {
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// IndexEndpoints hashes the endpoints of devices which aren't indexed
+// with the current key yet. Duplicates of another device's endpoint,
+// accepted by earlier releases, are left unindexed. It returns the
+// number of devices indexed.
+func (self DB) IndexEndpoints() (int, error) {
+	prefix := plainIndexPrefix
+	if self.cipher != nil {
+		prefix = self.cipher.current + ":"
+	}
+
+	res, err := self.connection.Query(
+		`select id, endpoint from devices where endpoint_hash is null
+		or substr(endpoint_hash, 1, ?)!=?`, len(prefix), prefix)
+
+	if err != nil {
+		return 0, err
+	}
+
+	endpoints := map[int64]string{}
+	for res.Next() {
+		var id int64
+		var endpoint string
+		if err = res.Scan(&id, &endpoint); err != nil {
+			res.Close()
+			return 0, err
+		}
+
+		if endpoints[id], err = self.openString("endpoint", deviceRow(id), endpoint); err != nil {
+			res.Close()
+			return 0, err
+		}
+	}
+	res.Close()
+
+	indexed := 0
+	for id, endpoint := range endpoints {
+		result, err := self.connection.Exec(
+			`update or ignore devices set endpoint_hash=? where id=?`,
+			self.fieldIndexes("endpoint", endpoint)[0], id)
+
+		if err != nil {
+			return indexed, err
+		}
+
+		if n, _ := result.RowsAffected(); n == 0 {
+			slog.Warn("Push endpoint is used by another device", "device_id", id)
+		} else {
+			indexed++
+		}
+	}
+
+	return indexed, nil
+}
+
+func (self DB) AddCommand(id int64, name, description string, destructive bool) (*Command, error) {
 	_, err := self.connection.Exec(
-		`insert into commands(id, name, description) values(?, ?, ?)`,
-		id, name, description)
+		`insert or replace into commands(id, name, description, destructive) values(?, ?, ?, ?)`,
+		id, name, description, destructive)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &Command{Id: id, Name: name, Description: description}, nil
+	return &Command{Id: id, Name: name, Description: description, Destructive: destructive}, nil
 }
 
 func (self DB) AddCommandForDevice(device, command int64) error {
@@ -133,25 +448,14 @@ func (self DB) UpdateCommandsForDevice(device int64, commands []int64) error {
 
 func (self DB) GetDeviceById(id int64) (*Device, error) {
 	row := self.connection.QueryRow(
-		`select id, user, name, endpoint, latitude, longitude, timestamp
-		from devices where id=?`, id)
+		`select `+deviceColumns+` from devices where id=?`, id)
 
-	d := Device{}
-	err := row.Scan(
-		&d.Id, &d.User, &d.Name,
-		&d.Endpoint, &d.Latitude,
-		&d.Longitude, &d.Timestamp)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &d, nil
+	return self.scanDevice(row)
 }
 
 func (self DB) ListCommandsForDevice(d *Device) ([]*Command, error) {
 	res, err := self.connection.Query(
-		`select id, name, description
+		`select id, name, description, destructive
 		from (commands, commands_for_device)
 		where commands.id = commands_for_device.command_id
 		and commands_for_device.device_id=?`, d.Id)
@@ -163,7 +467,7 @@ func (self DB) ListCommandsForDevice(d *Device) ([]*Command, error) {
 	commands := []*Command{}
 	for res.Next() {
 		c := Command{}
-		err = res.Scan(&c.Id, &c.Name, &c.Description)
+		err = res.Scan(&c.Id, &c.Name, &c.Description, &c.Destructive)
 
 		if err != nil {
 			return nil, err
@@ -175,18 +479,98 @@ func (self DB) ListCommandsForDevice(d *Device) ([]*Command, error) {
 	return commands, nil
 }
 
-func (self DB) UpdateDeviceLocation(device *Device, latitude, longitude float64) error {
-	_, err := self.connection.Exec(
-		`update devices set latitude=?, longitude=?, timestamp=strftime('%s', 'now')
-		where id=?`, latitude, longitude, device.Id)
-
+// UpdateDeviceLocation records a fix in the device's location history. It
+// becomes the device's current location unless a newer fix is known.
+func (self DB) UpdateDeviceLocation(device *Device, l Location) error {
+	_, err := self.AddDeviceLocations(device, []Location{l})
 	return err
 }
 
+// AddDeviceLocations records fixes in the device's location history,
+// ignoring the ones that were already known, and makes the newest fix
+// the device's current location. It returns the number of new fixes.
+func (self DB) AddDeviceLocations(device *Device, locations []Location) (int, error) {
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, l := range locations {
+		row := locationRow(device.Id, l.Timestamp)
+		latitude, err := self.sealFloat("latitude", row, l.Latitude)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		longitude, err := self.sealFloat("longitude", row, l.Longitude)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		res, err := tx.Exec(
+			`insert or ignore into locations(device_id, latitude, longitude,
+			accuracy, altitude, speed, heading, provider, battery, timestamp,
+			received)
+			values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, strftime('%s', 'now'))`,
+			device.Id, latitude, longitude, l.Accuracy, l.Altitude,
+			l.Speed, l.Heading, l.Provider, l.Battery, l.Timestamp)
+
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		n, _ := res.RowsAffected()
+		added += int(n)
+	}
+
+	// Coordinates and addresses are copied, sealed again for the device
+	// if encrypted
+	l := Location{}
+	var latitude, longitude, address string
+	err = tx.QueryRow(
+		`select latitude, longitude, accuracy, altitude, speed, heading,
+		provider, battery, timestamp, address from locations where device_id=?
+		order by timestamp desc, id desc limit 1`, device.Id).Scan(
+		&latitude, &longitude, &l.Accuracy, &l.Altitude, &l.Speed,
+		&l.Heading, &l.Provider, &l.Battery, &l.Timestamp, &address)
+
+	from, to := locationRow(device.Id, l.Timestamp), deviceRow(device.Id)
+	if err == nil {
+		latitude, err = self.resealString("latitude", from, to, latitude)
+	}
+
+	if err == nil {
+		longitude, err = self.resealString("longitude", from, to, longitude)
+	}
+
+	if err == nil {
+		address, err = self.resealString("address", from, to, address)
+	}
+
+	if err == nil {
+		_, err = tx.Exec(
+			`update devices set latitude=?, longitude=?, timestamp=?,
+			accuracy=?, altitude=?, speed=?, heading=?, provider=?, battery=?,
+			address=? where id=?`, latitude, longitude,
+			strconv.FormatInt(l.Timestamp, 10), l.Accuracy, l.Altitude,
+			l.Speed, l.Heading, l.Provider, l.Battery, address, device.Id)
+	}
+
+	if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return added, tx.Commit()
+}
+
 func (self DB) ListDevicesForUser(user string) ([]Device, error) {
 	res, err := self.connection.Query(
-		`select id, user, name, endpoint, latitude, longitude, timestamp
-		from devices where user=?`, user)
+		`select `+deviceColumns+` from devices where user=?`, user)
 
 	if err != nil {
 		return nil, err
@@ -194,14 +578,12 @@ func (self DB) ListDevicesForUser(user string) ([]Device, error) {
 
 	devices := make([]Device, 0)
 	for res.Next() {
-		d := Device{}
-		err = res.Scan(&d.Id, &d.User, &d.Name, &d.Endpoint, &d.Latitude,
-			&d.Longitude, &d.Timestamp)
+		d, err := self.scanDevice(res)
 		if err != nil {
 			return nil, err
 		}
 
-		devices = append(devices, d)
+		devices = append(devices, *d)
 	}
 
 	return devices, nil
@@ -1,8 +1,13 @@
 package main
 
+import "database/sql"
+import "encoding/base64"
+import "fmt"
 import "io/ioutil"
 import "os"
+import "strings"
 import "testing"
+import "time"
 
 /* The test devices we're going to use.
  * The values for Latitude, Longitude and Timestamp are the ones
@@ -26,7 +31,7 @@ var gTestDevices = []Device{
 var gTestCommands = []Command{
 	{Id: 1, Name: "Track", Description: "Start tracking a device"},
 	{Id: 2, Name: "Untrack", Description: "Stop tracking a device"},
-	{Id: 3, Name: "Wipe", Description: "Wipe a device's personal information"},
+	{Id: 3, Name: "Wipe", Description: "Wipe a device's personal information", Destructive: true},
 }
 
 func initTestDatabase(t *testing.T) (*DB, func()) {
@@ -39,7 +44,7 @@ func initTestDatabase(t *testing.T) (*DB, func()) {
 	db, err := OpenDB(testDBPath)
 
 	for _, command := range gTestCommands {
-		_, err := db.AddCommand(command.Id, command.Name, command.Description)
+		_, err := db.AddCommand(command.Id, command.Name, command.Description, command.Destructive)
 		if err != nil {
 			t.Log("Failed to add command: " + err.Error())
 			t.FailNow()
@@ -104,9 +109,13 @@ func TestUpdateDeviceLocation(t *testing.T) {
 
 	testLatitude := 37.38835
 	testLongitude := -122.082724
+	testAccuracy := 12.5
+
+	location := Location{Latitude: testLatitude, Longitude: testLongitude,
+		Accuracy: &testAccuracy, Provider: "gps", Timestamp: 1370000000}
 
 	if device, err := db.GetDeviceById(1); err == nil {
-		err = db.UpdateDeviceLocation(device, testLatitude, testLongitude)
+		err = db.UpdateDeviceLocation(device, location)
 		if err != nil {
 			t.Error("Failed to update device location: " + err.Error())
 		}
@@ -119,9 +128,23 @@ func TestUpdateDeviceLocation(t *testing.T) {
 			t.Errorf("Device has wrong coordinates: %#v", device)
 		}
 
-		if device.Timestamp == "" {
+		if device.Timestamp != "1370000000" {
 			t.Errorf("Timestamp for device was not updated: %#v", device)
 		}
+
+		if device.Accuracy == nil || *device.Accuracy != testAccuracy ||
+			device.Altitude != nil || device.Provider != "gps" {
+			t.Errorf("Device has wrong location details: %#v", device)
+		}
+
+		locations, err := db.ListLocationsForDevice(device, 0, 0)
+		if err != nil {
+			t.Error("Failed to list locations: " + err.Error())
+		}
+
+		if len(locations) != 1 || locations[0].Timestamp != location.Timestamp {
+			t.Errorf("Unexpected location history: %#v", locations)
+		}
 	} else {
 		panic(err)
 	}
@@ -181,3 +204,394 @@ func TestUpdateCommandsForDevice(t *testing.T) {
 		t.Errorf("Unexpected number of commands: %d", len(commands))
 	}
 }
+
+func TestAuditLog(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	entries := []AuditEntry{
+		{Actor: "ggp@mozilla.com", DeviceId: 1, Action: AuditCommand,
+			Command: "Wipe", SourceIP: "127.0.0.1", Outcome: "pushed"},
+		{Actor: "ggp@mozilla.com", DeviceId: 2, Action: AuditDeviceAdd,
+			SourceIP: "127.0.0.1", Outcome: "ok"},
+		{Actor: "ggoncalves@mozilla.com", DeviceId: 3, Action: AuditCommand,
+			Command: "Track", SourceIP: "10.0.0.1", Outcome: "pushed"},
+	}
+
+	for i := range entries {
+		if err := db.AddAuditEntry(&entries[i]); err != nil {
+			t.Fatal("Failed to add audit entry: " + err.Error())
+		}
+	}
+
+	result, err := db.ListAuditEntries(AuditFilter{Actor: "ggp@mozilla.com"})
+	if err != nil {
+		t.Fatal("Failed to list audit entries: " + err.Error())
+	}
+
+	if len(result) != 2 {
+		t.Errorf("Unexpected number of audit entries: %d", len(result))
+	}
+
+	result, err = db.ListAuditEntries(AuditFilter{Actor: "ggp@mozilla.com", Command: "Wipe"})
+	if err != nil {
+		t.Fatal("Failed to list audit entries: " + err.Error())
+	}
+
+	if len(result) != 1 || result[0].DeviceId != 1 || result[0].Timestamp == 0 {
+		t.Errorf("Unexpected audit entries: %#v", result)
+	}
+
+	// The log must be append-only
+	if _, err = db.connection.Exec(`update audit_log set outcome="ok"`); err == nil {
+		t.Errorf("Audit log entries could be updated")
+	}
+
+	if _, err = db.connection.Exec(`delete from audit_log`); err == nil {
+		t.Errorf("Audit log entries could be deleted")
+	}
+}
+
+func TestAddDeviceLocations(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	device, _ := db.GetDeviceById(1)
+	locations := []Location{
+		{Latitude: 48.8606, Longitude: 2.3376, Provider: "gps", Timestamp: 1370000300},
+		{Latitude: 48.8584, Longitude: 2.2945, Provider: "gps", Timestamp: 1370000100},
+	}
+
+	added, err := db.AddDeviceLocations(device, locations)
+	if err != nil || added != 2 {
+		t.Fatalf("Failed to add locations: %d, %v", added, err)
+	}
+
+	// Fixes older than the current one shouldn't move the device, and
+	// known fixes are ignored.
+	older := []Location{
+		{Latitude: 48.8530, Longitude: 2.3499, Timestamp: 1370000000},
+		{Latitude: 48.8584, Longitude: 2.2945, Provider: "gps", Timestamp: 1370000100},
+	}
+
+	added, err = db.AddDeviceLocations(device, older)
+	if err != nil || added != 1 {
+		t.Fatalf("Failed to add locations: %d, %v", added, err)
+	}
+
+	device, _ = db.GetDeviceById(1)
+	if device.Latitude != 48.8606 || device.Timestamp != "1370000300" {
+		t.Errorf("Device doesn't have the newest location: %#v", device)
+	}
+
+	history, _ := db.ListLocationsForDevice(device, 0, 0)
+	if len(history) != 3 || history[0].Timestamp != 1370000000 {
+		t.Errorf("Unexpected location history: %#v", history)
+	}
+
+	history, _ = db.ListLocationsForDevice(device, 1370000050, 1370000200)
+	if len(history) != 1 || history[0].Timestamp != 1370000100 {
+		t.Errorf("Unexpected location history: %#v", history)
+	}
+}
+
+func TestPruneLocations(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	now := time.Unix(1370000000, 0)
+	hour := int64(3600)
+	day := 24 * hour
+
+	device, _ := db.GetDeviceById(1)
+	db.AddDeviceLocations(device, []Location{
+		// Too old to keep at all
+		{Latitude: 1, Longitude: 1, Timestamp: now.Unix() - 40*day},
+		// Old enough to be downsampled, the first two in the same hour
+		{Latitude: 2, Longitude: 2, Timestamp: now.Unix() - 10*day},
+		{Latitude: 3, Longitude: 3, Timestamp: now.Unix() - 10*day + 60},
+		{Latitude: 4, Longitude: 4, Timestamp: now.Unix() - 10*day + hour},
+		// Recent
+		{Latitude: 5, Longitude: 5, Timestamp: now.Unix() - hour},
+		{Latitude: 6, Longitude: 6, Timestamp: now.Unix() - hour + 60},
+	})
+
+	// Reported late, after a fix taken later in the same hour
+	db.AddDeviceLocations(device, []Location{
+		{Latitude: 7, Longitude: 7, Timestamp: now.Unix() - 9*day + 600},
+	})
+	db.AddDeviceLocations(device, []Location{
+		{Latitude: 8, Longitude: 8, Timestamp: now.Unix() - 9*day + 60},
+	})
+
+	other, _ := db.GetDeviceById(3)
+	db.AddDeviceLocations(other, []Location{
+		{Latitude: 1, Longitude: 1, Timestamp: now.Unix() - 40*day},
+	})
+
+	gServerConfig = ServerConfig{
+		LocationRetention: RetentionPolicy{Days: 30, DownsampleDays: 7},
+		LocationRetentionOverrides: map[string]RetentionPolicy{
+			"ggoncalves@mozilla.com": {},
+		},
+	}
+	defer func() { gServerConfig = ServerConfig{} }()
+
+	if err := pruneLocations(db, now); err != nil {
+		t.Fatal("Failed to prune locations: " + err.Error())
+	}
+
+	locations, _ := db.ListLocationsForDevice(device, 0, 0)
+	latitudes := []float64{}
+	for _, l := range locations {
+		latitudes = append(latitudes, l.Latitude)
+	}
+
+	expected := []float64{2, 4, 8, 5, 6}
+	if len(latitudes) != len(expected) {
+		t.Fatalf("Unexpected locations after pruning: %v", latitudes)
+	}
+
+	for i := range expected {
+		if latitudes[i] != expected[i] {
+			t.Errorf("Unexpected locations after pruning: %v", latitudes)
+		}
+	}
+
+	// The override keeps everything for the other user
+	locations, _ = db.ListLocationsForDevice(other, 0, 0)
+	if len(locations) != 1 {
+		t.Errorf("Locations were pruned despite the override: %#v", locations)
+	}
+
+	// The current location goes away once it's too old as well
+	if err := pruneLocations(db, now.Add(31*24*time.Hour)); err != nil {
+		t.Fatal("Failed to prune locations: " + err.Error())
+	}
+
+	device, _ = db.GetDeviceById(1)
+	if device.Timestamp != "" || device.Latitude != 0 {
+		t.Errorf("Device kept an expired location: %#v", device)
+	}
+}
+
+func TestEncryptedFields(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	keys := map[string][]byte{
+		"a": []byte("0123456789abcdef0123456789abcdef"),
+		"b": []byte("fedcba9876543210fedcba9876543210"),
+	}
+
+	cipherA, err := NewFieldCipher(keys, "a")
+	if err != nil {
+		t.Fatal("Failed to create cipher: " + err.Error())
+	}
+
+	// Devices added before encryption was enabled are still readable
+	db.SetCipher(cipherA)
+	device, err := db.GetDeviceById(1)
+	if err != nil || device.Endpoint != gTestDevices[0].Endpoint {
+		t.Fatalf("Failed to read plaintext device: %v", err)
+	}
+
+	added, _ := db.AddDevice("ggp@mozilla.com", "encrypted", "http://push.mozilla.com/secret")
+
+	// Endpoints are unique whether they're encrypted or not
+	for _, endpoint := range []string{"http://push.mozilla.com/secret", gTestDevices[0].Endpoint} {
+		if _, err := db.AddDevice("ggoncalves@mozilla.com", "copy", endpoint); err == nil {
+			t.Errorf("Duplicate endpoint %s was accepted", endpoint)
+		}
+	}
+	db.UpdateDeviceLocation(added, Location{Latitude: 48.8606, Longitude: 2.3376, Timestamp: 1370000000})
+
+	var endpoint, latitude string
+	db.connection.QueryRow(`select endpoint, latitude from devices where id=?`, added.Id).Scan(&endpoint, &latitude)
+	if !strings.HasPrefix(endpoint, "enc2:a:") || !strings.HasPrefix(latitude, "enc2:a:") {
+		t.Errorf("Fields were not encrypted: %s, %s", endpoint, latitude)
+	}
+
+	db.connection.QueryRow(`select latitude from locations where device_id=?`, added.Id).Scan(&latitude)
+	if !strings.HasPrefix(latitude, "enc2:a:") {
+		t.Errorf("Location history was not encrypted: %s", latitude)
+	}
+
+	device, err = db.GetDeviceById(added.Id)
+	if err != nil || device.Endpoint != "http://push.mozilla.com/secret" || device.Latitude != 48.8606 {
+		t.Errorf("Failed to decrypt device: %#v, %v", device, err)
+	}
+
+	// Rotate to a new key
+	cipherB, _ := NewFieldCipher(keys, "b")
+	db.SetCipher(cipherB)
+
+	updated, err := db.Reencrypt()
+	if err != nil {
+		t.Fatal("Failed to re-encrypt: " + err.Error())
+	}
+
+	// All three plaintext devices, the encrypted one and its location
+	if updated != 5 {
+		t.Errorf("Unexpected number of re-encrypted rows: %d", updated)
+	}
+
+	db.connection.QueryRow(`select endpoint from devices where id=1`).Scan(&endpoint)
+	if !strings.HasPrefix(endpoint, "enc2:b:") {
+		t.Errorf("Plaintext field was not encrypted: %s", endpoint)
+	}
+
+	if indexed, err := db.IndexEndpoints(); err != nil || indexed != 4 {
+		t.Errorf("Unexpected number of indexed endpoints: %d, %v", indexed, err)
+	}
+
+	if _, err := db.AddDevice("ggoncalves@mozilla.com", "copy", "http://push.mozilla.com/secret"); err == nil {
+		t.Error("Duplicate endpoint was accepted after rotating keys")
+	}
+
+	locations, err := db.ListLocationsForDevice(added, 0, 0)
+	if err != nil || len(locations) != 1 || locations[0].Longitude != 2.3376 {
+		t.Errorf("Failed to decrypt locations: %#v, %v", locations, err)
+	}
+
+	// Without the key, encrypted values can't be read
+	onlyA, _ := NewFieldCipher(map[string][]byte{"a": keys["a"]}, "a")
+	db.SetCipher(onlyA)
+	if _, err = db.GetDeviceById(added.Id); err == nil {
+		t.Errorf("Decrypted a field with an unknown key")
+	}
+}
+
+func TestSealedFieldsAreBound(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	cipher, _ := NewFieldCipher(map[string][]byte{"a": []byte("0123456789abcdef0123456789abcdef")}, "a")
+	db.SetCipher(cipher)
+
+	first, _ := db.AddDevice("ggp@mozilla.com", "first", "http://push.mozilla.com/first")
+	second, _ := db.AddDevice("ggoncalves@mozilla.com", "second", "http://push.mozilla.com/second")
+
+	db.UpdateDeviceLocation(first, Location{Latitude: 48.8606, Longitude: 2.3376, Timestamp: 1370000000})
+
+	// A sealed value copied to another row can't be opened
+	db.connection.Exec(`update devices set latitude=(select latitude from devices where id=?) where id=?`, first.Id, second.Id)
+	if _, err := db.GetDeviceById(second.Id); err == nil {
+		t.Error("Latitude copied from another device was opened")
+	}
+
+	db.connection.Exec(`update locations set timestamp=1370000001 where device_id=?`, first.Id)
+	if _, err := db.ListLocationsForDevice(first, 0, 0); err == nil {
+		t.Error("Fix moved to another time was opened")
+	}
+
+	if _, err := db.GetDeviceById(first.Id); err != nil {
+		t.Errorf("Failed to open endpoint: %v", err)
+	}
+
+	// Values sealed by earlier releases are bound to the field only
+	aead := cipher.keys["a"]
+	nonce := make([]byte, aead.NonceSize())
+	legacy := legacyEncryptedPrefix + "a:" + base64.StdEncoding.EncodeToString(
+		aead.Seal(nonce, nonce, []byte("1.5"), []byte("latitude")))
+
+	if latitude, err := db.openFloat("latitude", deviceRow(first.Id), legacy); err != nil || latitude != 1.5 {
+		t.Errorf("Failed to open legacy value: %v, %v", latitude, err)
+	}
+
+	if !cipher.NeedsReencryption(legacy) {
+		t.Error("Legacy value doesn't need re-encryption")
+	}
+}
+
+func TestOpenBaselineDatabase(t *testing.T) {
+	file, err := ioutil.TempFile("", "whereismyfoxdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// The schema of releases before migrations
+	conn, _ := sql.Open(timedSQLiteDriver, file.Name())
+	_, err = conn.Exec(
+		`create table devices
+		(id integer primary key autoincrement,
+		user text, name text, endpoint text unique,
+		latitude float default 0, longitude float default 0,
+		timestamp text default "");
+		create table commands
+		(id integer primary key, name text, description text,
+		unique (id, name, description));
+		create table commands_for_device
+		(device_id integer references devices(id),
+		command_id integer references commands(id),
+		primary key (device_id, command_id));
+		insert into devices(user, name, endpoint)
+		values ("ggp@mozilla.com", "phone", "http://push.example.com/phone");
+		insert into commands(id, name, description) values (1, "Track", "Start tracking a device");
+		insert into commands_for_device values (1, 1);`)
+	conn.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDB(file.Name())
+	if err != nil {
+		t.Fatal("Failed to open baseline database: " + err.Error())
+	}
+	defer db.Close()
+
+	if err = populateCommandsDB(db, "commands.json"); err != nil {
+		t.Fatal("Failed to load commands: " + err.Error())
+	}
+
+	device, err := db.GetDeviceById(1)
+	if err != nil || device.Endpoint != "http://push.example.com/phone" {
+		t.Fatalf("Unexpected device: %#v, %v", device, err)
+	}
+
+	if commands, _ := db.ListCommandsForDevice(device); len(commands) != 1 || commands[0].Name != "Stop tracking" {
+		t.Errorf("Unexpected commands: %#v", commands)
+	}
+}
+
+func TestLocationsUniqueMigration(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	schema := func() (indexes, triggers int) {
+		db.connection.QueryRow(`select count(*) from sqlite_master
+			where name="locations_unique" and type="index"`).Scan(&indexes)
+		db.connection.QueryRow(`select count(*) from sqlite_master
+			where name="locations_unique" and type="trigger"`).Scan(&triggers)
+		return
+	}
+
+	if indexes, triggers := schema(); indexes != 0 || triggers != 1 {
+		t.Errorf("Unexpected schema: %d indexes, %d triggers", indexes, triggers)
+	}
+
+	// As databases which got the trigger from an earlier migration 3
+	db.connection.Exec(fmt.Sprintf(`pragma user_version = %d`, len(migrations)-1))
+	if err := migrate(db.connection); err != nil {
+		t.Fatal("Failed to migrate: " + err.Error())
+	}
+
+	if indexes, triggers := schema(); indexes != 0 || triggers != 1 {
+		t.Errorf("Unexpected schema: %d indexes, %d triggers", indexes, triggers)
+	}
+
+	device, _ := db.GetDeviceById(1)
+	now := time.Now().Unix()
+	added, err := db.AddDeviceLocations(device, []Location{{Latitude: 1, Longitude: 1, Timestamp: now}})
+	if err != nil || added != 1 {
+		t.Fatalf("Failed to add location: %d, %v", added, err)
+	}
+
+	db.AddDeviceLocations(device, []Location{{Latitude: 2, Longitude: 2, Timestamp: now}})
+	if locations, _ := db.ListLocationsForDevice(device, now, now); len(locations) != 1 || locations[0].Latitude != 1 {
+		t.Errorf("Unexpected locations: %#v", locations)
+	}
+}
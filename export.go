@@ -0,0 +1,474 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An account export is a zip of everything kept about a user: their
+// devices, the location history of each as GeoJSON, the commands sent to
+// them and the audit log. Small accounts are exported right away, larger
+// ones in the background, into ExportDir, until ExportRetentionHours
+// passed.
+const exportSyncLocations = 10000
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+type ExportJob struct {
+	Id       string `json:"id"`
+	User     string `json:"-"`
+	Status   string `json:"status"`
+	Created  int64  `json:"created"`
+	Finished int64  `json:"finished,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+
+	// Where to fetch the zip from once ready
+	Download string `json:"download,omitempty"`
+}
+
+type exportAccount struct {
+	User         string `json:"user"`
+	Exported     string `json:"exported"`
+	TOTPEnrolled bool   `json:"totpEnrolled"`
+}
+
+type exportDevice struct {
+	Device
+	Commands []*Command `json:"commands"`
+}
+
+type exportInvocation struct {
+	Token     int64       `json:"token"`
+	DeviceId  int64       `json:"deviceId"`
+	CommandId int64       `json:"commandId"`
+	Arguments interface{} `json:"arguments"`
+	Created   int64       `json:"created"`
+}
+
+type exportInvocations struct {
+	// Commands sent, as recorded in the audit log
+	History []AuditEntry `json:"history"`
+
+	// Commands pushed which their device didn't fetch yet
+	Pending []exportInvocation `json:"pending"`
+}
+
+// Exports in the background, so that shutting down can wait for them.
+var gExports sync.WaitGroup
+
+func newExportId() string {
+	return newSessionToken()
+}
+
+func (self DB) CountLocationsForUser(user string) (int, error) {
+	var count int
+	err := self.connection.QueryRow(
+		`select count(*) from locations where device_id in
+		(select id from devices where user=?)`, user).Scan(&count)
+
+	return count, err
+}
+
+const exportColumns = `id, user, status, created, finished, size`
+
+func (self DB) scanExport(row scanner) (*ExportJob, error) {
+	e := ExportJob{}
+	if err := row.Scan(&e.Id, &e.User, &e.Status, &e.Created, &e.Finished, &e.Size); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (self DB) CreateExport(user, id string, now time.Time) (*ExportJob, error) {
+	_, err := self.connection.Exec(
+		`insert into exports (id, user, status, created) values (?, ?, ?, ?)`,
+		id, user, ExportPending, now.Unix())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExportJob{Id: id, User: user, Status: ExportPending, Created: now.Unix()}, nil
+}
+
+func (self DB) FinishExport(id, status string, size int64, now time.Time) error {
+	_, err := self.connection.Exec(
+		`update exports set status=?, size=?, finished=? where id=?`,
+		status, size, now.Unix(), id)
+
+	return err
+}
+
+// GetExport returns nil if the user has no such export.
+func (self DB) GetExport(user, id string) (*ExportJob, error) {
+	row := self.connection.QueryRow(
+		`select `+exportColumns+` from exports where user=? and id=?`, user, id)
+
+	export, err := self.scanExport(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return export, err
+}
+
+// GetPendingExport returns the export of the user still being written,
+// or nil.
+func (self DB) GetPendingExport(user string) (*ExportJob, error) {
+	row := self.connection.QueryRow(
+		`select `+exportColumns+` from exports where user=? and status=?`,
+		user, ExportPending)
+
+	export, err := self.scanExport(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return export, err
+}
+
+// FailPendingExports marks exports interrupted by a restart as failed.
+func (self DB) FailPendingExports(now time.Time) error {
+	_, err := self.connection.Exec(
+		`update exports set status=?, finished=? where status=?`,
+		ExportFailed, now.Unix(), ExportPending)
+
+	return err
+}
+
+func (self DB) ListExportsCreatedBefore(before int64) ([]ExportJob, error) {
+	return self.listExports(
+		`select `+exportColumns+` from exports where created<? and status!=?`,
+		before, ExportPending)
+}
+
+func (self DB) ListExportsForUser(user string) ([]ExportJob, error) {
+	return self.listExports(
+		`select `+exportColumns+` from exports where user=? order by created`, user)
+}
+
+func (self DB) listExports(query string, args ...interface{}) ([]ExportJob, error) {
+	res, err := self.connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	exports := []ExportJob{}
+	for res.Next() {
+		e, err := self.scanExport(res)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, *e)
+	}
+
+	return exports, res.Err()
+}
+
+func (self DB) DeleteExport(id string) error {
+	_, err := self.connection.Exec(`delete from exports where id=?`, id)
+	return err
+}
+
+func exportFile(config ServerConfig, id string) string {
+	return filepath.Join(config.ExportDir, id+".zip")
+}
+
+// pruneExports deletes exports, and their files, older than the
+// retention.
+func pruneExports(db *DB, now time.Time) error {
+	before := now.Add(-time.Duration(gServerConfig.ExportRetentionHours) * time.Hour).Unix()
+
+	exports, err := db.ListExportsCreatedBefore(before)
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if err = os.Remove(exportFile(gServerConfig, export.Id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if err = db.DeleteExport(export.Id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeAccountExport writes the zip of everything kept about user.
+func writeAccountExport(db *DB, user string, w io.Writer, now time.Time) error {
+	archive := zip.NewWriter(w)
+
+	secret, err := db.GetTOTPSecret(user)
+	if err != nil {
+		return err
+	}
+
+	account := exportAccount{user, now.UTC().Format(time.RFC3339), secret != ""}
+	if err = writeZipJSON(archive, "account.json", account); err != nil {
+		return err
+	}
+
+	devices, err := db.ListDevicesForUser(user)
+	if err != nil {
+		return err
+	}
+
+	exported := []exportDevice{}
+	owned := map[int64]bool{}
+	for i := range devices {
+		device := &devices[i]
+		owned[device.Id] = true
+
+		commands, err := db.ListCommandsForDevice(device)
+		if err != nil {
+			return err
+		}
+		exported = append(exported, exportDevice{*device, commands})
+
+		locations, err := db.ListLocationsForDevice(device, 0, 0)
+		if err != nil {
+			return err
+		}
+
+		track, err := archive.Create(fmt.Sprintf("locations/device-%d.geojson", device.Id))
+		if err != nil {
+			return err
+		}
+
+		if err = writeGeoJSONTrack(track, device, locations); err != nil {
+			return err
+		}
+	}
+
+	if err = writeZipJSON(archive, "devices.json", exported); err != nil {
+		return err
+	}
+
+	history, err := db.ListAuditEntries(AuditFilter{Actor: user, Action: AuditCommand})
+	if err != nil {
+		return err
+	}
+
+	invocations, err := db.ListInvocations()
+	if err != nil {
+		return err
+	}
+
+	pending := []exportInvocation{}
+	for _, i := range invocations {
+		if owned[i.DeviceId] {
+			pending = append(pending, exportInvocation{i.Token, i.DeviceId, i.CommandId, i.Arguments, i.Created})
+		}
+	}
+
+	if err = writeZipJSON(archive, "invocations.json", exportInvocations{history, pending}); err != nil {
+		return err
+	}
+
+	entries, err := db.ListAuditEntries(AuditFilter{Actor: user})
+	if err != nil {
+		return err
+	}
+
+	if err = writeZipJSON(archive, "audit.json", entries); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// runExport writes the export in the background, next to its final name
+// until complete.
+func runExport(db *DB, export *ExportJob, config ServerConfig) {
+	defer gExports.Done()
+
+	start := time.Now()
+	file := exportFile(config, export.Id)
+	partial := file + ".partial"
+	defer os.Remove(partial)
+
+	size, err := int64(0), os.MkdirAll(config.ExportDir, 0700)
+	if err == nil {
+		err = writeAccountExportFile(db, export.User, partial, start)
+	}
+
+	if err == nil {
+		err = os.Rename(partial, file)
+	}
+
+	if err == nil {
+		var stat os.FileInfo
+		if stat, err = os.Stat(file); err == nil {
+			size = stat.Size()
+		}
+	}
+
+	status := ExportReady
+	if err != nil {
+		status = ExportFailed
+		slog.Error("Failed to export account", "actor", export.User, "export", export.Id, "error", err)
+	}
+
+	if err = db.FinishExport(export.Id, status, size, time.Now()); err != nil {
+		slog.Error("Failed to record export", "export", export.Id, "error", err)
+	}
+
+	slog.Info("export", "actor", export.User, "export", export.Id, "outcome", status,
+		"size", size, "duration_ms", time.Since(start).Milliseconds())
+}
+
+func writeAccountExportFile(db *DB, user, file string, now time.Time) error {
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = writeAccountExport(db, user, out, now)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// waitForExports blocks until every export in the background is done, or
+// until ctx expires.
+func waitForExports(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		gExports.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func exportDownloadLink(request *restful.Request, export *ExportJob) string {
+	if export.Status != ExportReady {
+		return ""
+	}
+	return apiRoot(request) + "/account/export/" + export.Id + "/download"
+}
+
+func exportFilename(now time.Time) string {
+	return fmt.Sprintf(`attachment; filename="whereismyfox-export-%s.zip"`, now.UTC().Format("20060102"))
+}
+
+// exportAccountData sends small accounts' zip right away. Larger accounts,
+// or when async is set, get a job to poll instead, which is reused while
+// pending.
+func exportAccountData(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+
+	count, err := gDB.CountLocationsForUser(user)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to export account")
+		return
+	}
+
+	now := time.Now()
+	if count <= exportSyncLocations && request.QueryParameter("async") != "true" {
+		audit(request, 0, AuditAccountExport, "", nil, "ok")
+		response.AddHeader("Content-Type", "application/zip")
+		response.AddHeader("Content-Disposition", exportFilename(now))
+		if err = writeAccountExport(gDB, user, response, now); err != nil {
+			slog.ErrorContext(request.Request.Context(), "Failed to export account", "error", err)
+		}
+		return
+	}
+
+	export, err := gDB.GetPendingExport(user)
+	if err == nil && export == nil {
+		if export, err = gDB.CreateExport(user, newExportId(), now); err == nil {
+			gExports.Add(1)
+			go runExport(gDB, export, gServerConfig)
+		}
+	}
+
+	if err != nil {
+		audit(request, 0, AuditAccountExport, "", nil, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to export account")
+		return
+	}
+
+	audit(request, 0, AuditAccountExport, "", map[string]string{"export": export.Id}, "pending")
+	response.AddHeader("Location", apiRoot(request)+"/account/export/"+export.Id)
+	response.WriteHeaderAndEntity(http.StatusAccepted, export)
+}
+
+func getExportForRequest(request *restful.Request, response *restful.Response) *ExportJob {
+	export, err := gDB.GetExport(gPersona.GetLoginName(request.Request), request.PathParameter("export-id"))
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve export")
+		return nil
+	}
+
+	if export == nil {
+		writeError(request, response, http.StatusNotFound, ErrExportNotFound, "Export not found")
+		return nil
+	}
+
+	export.Download = exportDownloadLink(request, export)
+	return export
+}
+
+func serveExport(request *restful.Request, response *restful.Response) {
+	if export := getExportForRequest(request, response); export != nil {
+		response.WriteEntity(export)
+	}
+}
+
+func downloadExport(request *restful.Request, response *restful.Response) {
+	export := getExportForRequest(request, response)
+	if export == nil {
+		return
+	}
+
+	if export.Status != ExportReady {
+		writeError(request, response, http.StatusConflict, ErrExportNotReady, "Export is "+export.Status)
+		return
+	}
+
+	file, err := os.Open(exportFile(gServerConfig, export.Id))
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve export")
+		return
+	}
+	defer file.Close()
+
+	response.AddHeader("Content-Type", "application/zip")
+	response.AddHeader("Content-Disposition", exportFilename(time.Unix(export.Created, 0)))
+	io.Copy(response, file)
+}
@@ -0,0 +1,148 @@
+package main
+
+import "archive/zip"
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+import "github.com/emicklei/go-restful"
+
+func readExportZip(t *testing.T, data []byte) map[string][]byte {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], _ = ioutil.ReadAll(f)
+		f.Close()
+	}
+	return files
+}
+
+func TestAccountExport(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	gDB.UpdateDeviceLocation(&gTestDevices[0], Location{Latitude: 1, Longitude: 2, Timestamp: time.Now().Unix()})
+	gDB.AddInvocation(1234, 2, CommandContext{1, nil}, time.Now())
+	gDB.AddInvocation(5678, 3, CommandContext{1, nil}, time.Now())
+
+	response := doWebServiceRequest("POST", "/api/v1/account/export", "{}")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Unexpected response: %d %s", response.Code, response.Body.String())
+	}
+
+	files := readExportZip(t, response.Body.Bytes())
+	for _, name := range []string{"account.json", "devices.json", "invocations.json", "audit.json",
+		"locations/device-1.geojson", "locations/device-2.geojson"} {
+		if _, exists := files[name]; !exists {
+			t.Errorf("%s is missing from the export", name)
+		}
+	}
+
+	if _, exists := files["locations/device-3.geojson"]; exists {
+		t.Error("Another user's device was exported")
+	}
+
+	devices := []exportDevice{}
+	json.Unmarshal(files["devices.json"], &devices)
+	if len(devices) != 2 || len(devices[1].Commands) != 2 {
+		t.Errorf("Unexpected devices: %#v", devices)
+	}
+
+	track := geoJSONFeatureCollection{}
+	json.Unmarshal(files["locations/device-1.geojson"], &track)
+	if len(track.Features) != 1 {
+		t.Errorf("Unexpected location history: %#v", track)
+	}
+
+	invocations := exportInvocations{}
+	json.Unmarshal(files["invocations.json"], &invocations)
+	if len(invocations.Pending) != 1 || invocations.Pending[0].Token != 1234 {
+		t.Errorf("Unexpected invocations: %#v", invocations)
+	}
+}
+
+func TestAsyncAccountExport(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "whereismyfoxexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gServerConfig.ExportDir = dir
+
+	// Exports are only started by requests carrying the CSRF token
+	if response := doWebServiceRequest("GET", "/api/v1/account/export?async=true", ""); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected response code for GET: %d", response.Code)
+	}
+
+	request, _ := http.NewRequest("POST", "/api/v1/account/export?async=true", strings.NewReader("{}"))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(response, request)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Unexpected response code without token: %d", response.Code)
+	}
+
+	if exports, _ := gDB.ListExportsForUser("ggp@mozilla.com"); len(exports) != 0 {
+		t.Fatalf("Exports were started: %#v", exports)
+	}
+
+	response = doWebServiceRequest("POST", "/api/v1/account/export?async=true", "{}")
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	export := ExportJob{}
+	json.Unmarshal(response.Body.Bytes(), &export)
+	if export.Status != ExportPending || response.Header().Get("Location") != "/api/v1/account/export/"+export.Id {
+		t.Errorf("Unexpected export: %#v", export)
+	}
+
+	gExports.Wait()
+
+	response = doWebServiceRequest("GET", "/api/v1/account/export/"+export.Id, "")
+	json.Unmarshal(response.Body.Bytes(), &export)
+	if export.Status != ExportReady || export.Download != "/api/v1/account/export/"+export.Id+"/download" {
+		t.Fatalf("Unexpected export: %#v", export)
+	}
+
+	response = doWebServiceRequest("GET", export.Download, "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	if files := readExportZip(t, response.Body.Bytes()); len(files) == 0 {
+		t.Error("Export is empty")
+	}
+
+	other, _ := gDB.CreateExport("ggoncalves@mozilla.com", "other", time.Now())
+	if response := doWebServiceRequest("GET", "/api/v1/account/export/"+other.Id, ""); response.Code != http.StatusNotFound {
+		t.Errorf("Another user's export was found: %d", response.Code)
+	}
+
+	// Expired exports are deleted with their file
+	gServerConfig.ExportRetentionHours = 1
+	if err := pruneExports(gDB, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(exportFile(gServerConfig, export.Id)); !os.IsNotExist(err) {
+		t.Error("Expired export wasn't deleted")
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reported fixes are given a human readable address in the background,
+// by the provider set in "geocoder". Answers are cached for each user by
+// coordinates rounded to geocodeCachePrecision decimals, about 100
+// meters, so that a device which doesn't move isn't looked up again and
+// again. A user's answers are deleted with their locations.
+const (
+	geocodeCachePrecision = 3
+	geocodeCacheLifetime  = 30 * 24 * time.Hour
+	geocodeQueueSize      = 1000
+	geocodeTimeout        = 10 * time.Second
+)
+
+// Fixes farther than this from every city of the dataset get no address.
+const offlineGeocoderRange = 50.0
+
+// The public Nominatim instance asks for at most one request per second,
+// from an identifiable client.
+const (
+	nominatimInterval  = time.Second
+	nominatimUserAgent = "whereismyfox (https://github.com/dougt/whereismyfox)"
+)
+
+const (
+	GeocoderOffline   = "offline"
+	GeocoderNominatim = "nominatim"
+)
+
+// A Geocoder turns coordinates into an address. An empty address with no
+// error means there's nothing known there.
+type Geocoder interface {
+	Name() string
+	ReverseGeocode(latitude, longitude float64) (string, error)
+}
+
+type geoNamesCity struct {
+	Name      string
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// OfflineGeocoder names the closest city of a GeoNames dataset.
+type OfflineGeocoder struct {
+	cities []geoNamesCity
+}
+
+// loadOfflineGeocoder reads a dataset in the format of the GeoNames
+// cities files: tab separated, with the name, latitude, longitude and
+// country code in the 2nd, 5th, 6th and 9th columns.
+func loadOfflineGeocoder(file string) (*OfflineGeocoder, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	geocoder := &OfflineGeocoder{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("%s:%d: expected at least 9 columns", file, n)
+		}
+
+		city := geoNamesCity{Name: fields[1], Country: fields[8]}
+		city.Latitude, err = strconv.ParseFloat(fields[4], 64)
+		if err == nil {
+			city.Longitude, err = strconv.ParseFloat(fields[5], 64)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid coordinates", file, n)
+		}
+
+		geocoder.cities = append(geocoder.cities, city)
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(geocoder.cities) == 0 {
+		return nil, fmt.Errorf("%s has no cities", file)
+	}
+
+	return geocoder, nil
+}
+
+// distanceKm is the great-circle distance between two points.
+func distanceKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := math.Pi / 180
+
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func (self *OfflineGeocoder) Name() string {
+	return GeocoderOffline
+}
+
+func (self *OfflineGeocoder) ReverseGeocode(latitude, longitude float64) (string, error) {
+	var closest *geoNamesCity
+	best := offlineGeocoderRange
+
+	for i, city := range self.cities {
+		if d := distanceKm(latitude, longitude, city.Latitude, city.Longitude); d <= best {
+			closest, best = &self.cities[i], d
+		}
+	}
+
+	if closest == nil {
+		return "", nil
+	}
+
+	if closest.Country == "" {
+		return closest.Name, nil
+	}
+	return closest.Name + ", " + closest.Country, nil
+}
+
+// NominatimGeocoder asks a server implementing the Nominatim reverse API,
+// such as https://nominatim.openstreetmap.org, waiting interval between
+// requests.
+type NominatimGeocoder struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	lock sync.Mutex
+	last time.Time
+}
+
+type nominatimResponse struct {
+	Error       string            `json:"error"`
+	DisplayName string            `json:"display_name"`
+	Address     map[string]string `json:"address"`
+}
+
+func newNominatimGeocoder(serverURL string) *NominatimGeocoder {
+	return &NominatimGeocoder{
+		url:      strings.TrimSuffix(serverURL, "/"),
+		interval: nominatimInterval,
+		client:   &http.Client{Timeout: geocodeTimeout},
+	}
+}
+
+func (self *NominatimGeocoder) Name() string {
+	return GeocoderNominatim
+}
+
+func (self *NominatimGeocoder) wait() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if wait := self.last.Add(self.interval).Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+	self.last = time.Now()
+}
+
+// formatNominatimAddress keeps the street, the locality and the country,
+// rather than the whole display name down to the postcode.
+func formatNominatimAddress(response nominatimResponse) string {
+	keys := [][]string{
+		{"road", "pedestrian", "footway", "path"},
+		{"city", "town", "village", "hamlet", "suburb"},
+		{"country"},
+	}
+
+	parts := []string{}
+	for _, alternatives := range keys {
+		for _, key := range alternatives {
+			if value := response.Address[key]; value != "" {
+				parts = append(parts, value)
+				break
+			}
+		}
+	}
+
+	if len(parts) == 0 {
+		return response.DisplayName
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (self *NominatimGeocoder) ReverseGeocode(latitude, longitude float64) (string, error) {
+	self.wait()
+
+	query := url.Values{
+		"format":         {"jsonv2"},
+		"lat":            {strconv.FormatFloat(latitude, 'f', -1, 64)},
+		"lon":            {strconv.FormatFloat(longitude, 'f', -1, 64)},
+		"zoom":           {"18"},
+		"addressdetails": {"1"},
+	}
+
+	request, err := http.NewRequest("GET", self.url+"/reverse?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("User-Agent", nominatimUserAgent)
+
+	response, err := self.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Nominatim answered %s", response.Status)
+	}
+
+	result := nominatimResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", err
+	}
+
+	// Nominatim reports places it knows nothing about, like the middle of
+	// the ocean, as errors
+	if result.Error != "" {
+		return "", nil
+	}
+
+	return formatNominatimAddress(result), nil
+}
+
+// loadGeocoder returns the provider set in the configuration, or nil if
+// geocoding is disabled.
+func loadGeocoder(config ServerConfig) (Geocoder, error) {
+	switch config.Geocoder {
+	case "":
+		return nil, nil
+	case GeocoderOffline:
+		dataset := config.GeocoderDataset
+		if dataset == "" {
+			dataset = path.Join(config.PackagePath, "geonames-cities.txt")
+		}
+		return loadOfflineGeocoder(dataset)
+	case GeocoderNominatim:
+		return newNominatimGeocoder(config.NominatimURL), nil
+	}
+
+	return nil, fmt.Errorf("Unknown geocoder %s", config.Geocoder)
+}
+
+// geocodeCacheKey hashes the user and the rounded coordinates with a
+// server secret, derived from the encryption key if there's one, or the
+// session cookie key, so that the coordinates can't be guessed back from
+// the cache. Addresses are encrypted like coordinates are. Entries just
+// miss once the secret changes.
+func (self DB) geocodeCacheKey(user, provider string, latitude, longitude float64) string {
+	key := fmt.Sprintf("%s:%s:%.*f,%.*f", user, provider,
+		geocodeCachePrecision, latitude, geocodeCachePrecision, longitude)
+	return self.keyedHash("geocode", key)
+}
+
+// GetCachedAddress returns the address cached since the given time, and
+// whether there was one.
+func (self DB) GetCachedAddress(key string, since int64) (string, bool, error) {
+	var address string
+	err := self.connection.QueryRow(
+		`select address from geocode_cache where key=? and created>=?`,
+		key, since).Scan(&address)
+
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	address, err = self.openString("address", key, address)
+	return address, err == nil, err
+}
+
+func (self DB) CacheAddress(user, key, address string, now time.Time) error {
+	sealed, err := self.sealString("address", key, address)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.connection.Exec(
+		`insert or replace into geocode_cache(user, key, address, created)
+		values(?, ?, ?, ?)`, user, key, sealed, now.Unix())
+
+	return err
+}
+
+// DeleteCachedAddresses forgets the addresses looked up for the user
+// before the given time, or all of them if zero.
+func (self DB) DeleteCachedAddresses(user string, before int64) error {
+	query := `delete from geocode_cache where user=?`
+	args := []interface{}{user}
+
+	if before != 0 {
+		query += ` and created<?`
+		args = append(args, before)
+	}
+
+	_, err := self.connection.Exec(query, args...)
+	return err
+}
+
+func (self DB) PruneGeocodeCache(before int64) (int64, error) {
+	res, err := self.connection.Exec(`delete from geocode_cache where created<?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func pruneGeocodeCache(db *DB, now time.Time) error {
+	_, err := db.PruneGeocodeCache(now.Add(-geocodeCacheLifetime).Unix())
+	return err
+}
+
+// SetLocationAddress sets the address of a fix, and of the device if
+// that's still its current location.
+func (self DB) SetLocationAddress(deviceId, timestamp int64, address string) error {
+	sealed, err := self.sealString("address", locationRow(deviceId, timestamp), address)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.connection.Exec(
+		`update locations set address=? where device_id=? and timestamp=?`,
+		sealed, deviceId, timestamp)
+
+	if err == nil {
+		sealed, err = self.sealString("address", deviceRow(deviceId), address)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = self.connection.Exec(
+		`update devices set address=? where id=? and timestamp=?`,
+		sealed, deviceId, strconv.FormatInt(timestamp, 10))
+
+	return err
+}
+
+// reverseGeocode looks the coordinates up in the cache before asking the
+// geocoder. Places with no address are cached too.
+func reverseGeocode(db *DB, geocoder Geocoder, user string, latitude, longitude float64, now time.Time) (string, error) {
+	key := db.geocodeCacheKey(user, geocoder.Name(), latitude, longitude)
+
+	address, cached, err := db.GetCachedAddress(key, now.Add(-geocodeCacheLifetime).Unix())
+	if err != nil {
+		return "", err
+	}
+
+	if cached {
+		gGeocodeLookups.WithLabelValues(geocoder.Name(), "cached").Inc()
+		return address, nil
+	}
+
+	address, err = geocoder.ReverseGeocode(latitude, longitude)
+	if err != nil {
+		gGeocodeLookups.WithLabelValues(geocoder.Name(), "error").Inc()
+		return "", err
+	}
+
+	if address == "" {
+		gGeocodeLookups.WithLabelValues(geocoder.Name(), "none").Inc()
+	} else {
+		gGeocodeLookups.WithLabelValues(geocoder.Name(), "found").Inc()
+	}
+
+	return address, db.CacheAddress(user, key, address, now)
+}
+
+// geocodeLocation looks up the fix stored for l's timestamp, which isn't l
+// when l was dropped for coming in the same second as another. Fixes
+// deleted while queued are skipped, as they would be cached again.
+func geocodeLocation(db *DB, geocoder Geocoder, device *Device, l Location) error {
+	stored, err := db.ListLocationsForDevice(device, l.Timestamp, l.Timestamp)
+	if err != nil || len(stored) == 0 {
+		return err
+	}
+
+	l = stored[0]
+	address, err := reverseGeocode(db, geocoder, device.User, l.Latitude, l.Longitude, time.Now())
+	if err != nil || address == "" {
+		return err
+	}
+
+	return db.SetLocationAddress(device.Id, l.Timestamp, address)
+}
+
+type geocodeJob struct {
+	device   *Device
+	location Location
+}
+
+var gGeocoder Geocoder
+var gGeocodeQueue chan geocodeJob
+
+// queueGeocoding has the fixes geocoded in the background. Fixes are
+// dropped, and keep no address, when the queue is full.
+func queueGeocoding(device *Device, locations []Location) {
+	if gGeocodeQueue == nil {
+		return
+	}
+
+	for _, l := range locations {
+		select {
+		case gGeocodeQueue <- geocodeJob{device, l}:
+		default:
+			slog.Warn("Geocoding queue is full", "device_id", device.Id)
+			return
+		}
+	}
+}
+
+// startGeocoder geocodes queued fixes with gGeocoder, one at a time, until
+// the returned function is called.
+func startGeocoder(db *DB) func() {
+	if gGeocoder == nil {
+		return func() {}
+	}
+
+	gGeocodeQueue = make(chan geocodeJob, geocodeQueueSize)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case job := <-gGeocodeQueue:
+				if err := geocodeLocation(db, gGeocoder, job.device, job.location); err != nil {
+					slog.Error("Failed to geocode location", "device_id", job.device.Id, "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
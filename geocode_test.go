@@ -0,0 +1,224 @@
+package main
+
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "testing"
+import "time"
+
+// CountingGeocoder answers with a fixed address, counting the lookups.
+type CountingGeocoder struct {
+	address string
+	calls   *int
+}
+
+func (self CountingGeocoder) Name() string {
+	return "counting"
+}
+
+func (self CountingGeocoder) ReverseGeocode(latitude, longitude float64) (string, error) {
+	*self.calls++
+	return self.address, nil
+}
+
+// LastGeocoder remembers the latitude it was last asked about.
+type LastGeocoder struct {
+	latitude *float64
+}
+
+func (self LastGeocoder) Name() string {
+	return "last"
+}
+
+func (self LastGeocoder) ReverseGeocode(latitude, longitude float64) (string, error) {
+	*self.latitude = latitude
+	return "Somewhere", nil
+}
+
+func TestOfflineGeocoder(t *testing.T) {
+	geocoder, err := loadOfflineGeocoder("geonames-cities.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address, _ := geocoder.ReverseGeocode(48.8606, 2.3376); address != "Paris, FR" {
+		t.Errorf("Unexpected address: %q", address)
+	}
+
+	// The middle of the Pacific
+	if address, _ := geocoder.ReverseGeocode(0, -140); address != "" {
+		t.Errorf("Unexpected address: %q", address)
+	}
+
+	file, err := ioutil.TempFile("", "whereismyfoxcities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("1\tParis\tParis\t\tnorth\teast\tP\tPPL\tFR\n")
+	file.Close()
+
+	if _, err := loadOfflineGeocoder(file.Name()); err == nil {
+		t.Error("Invalid dataset was loaded")
+	}
+}
+
+func TestNominatimGeocoder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/reverse" || r.Header.Get("User-Agent") != nominatimUserAgent {
+			t.Errorf("Unexpected request: %s %#v", r.URL, r.Header)
+		}
+
+		switch r.FormValue("lat") {
+		case "48.8606":
+			w.Write([]byte(`{"display_name": "Rue de Rivoli, Quartier des Halles, Paris, 75001, France",
+				"address": {"road": "Rue de Rivoli", "city": "Paris", "postcode": "75001", "country": "France"}}`))
+		case "0":
+			w.Write([]byte(`{"error": "Unable to geocode"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	geocoder := newNominatimGeocoder(server.URL + "/")
+	geocoder.interval = 0
+
+	if address, err := geocoder.ReverseGeocode(48.8606, 2.3376); err != nil || address != "Rue de Rivoli, Paris, France" {
+		t.Errorf("Unexpected address: %q, %v", address, err)
+	}
+
+	if address, err := geocoder.ReverseGeocode(0, -140); err != nil || address != "" {
+		t.Errorf("Unexpected address: %q, %v", address, err)
+	}
+
+	if _, err := geocoder.ReverseGeocode(1, 1); err == nil {
+		t.Error("Server error wasn't reported")
+	}
+}
+
+func TestGeocodeLocations(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	calls := 0
+	geocoder := CountingGeocoder{"Rue de Rivoli, Paris, France", &calls}
+
+	now := time.Now().Unix()
+	fixes := []Location{
+		{Latitude: 48.86061, Longitude: 2.33761, Timestamp: now - 60},
+		{Latitude: 48.86064, Longitude: 2.33764, Timestamp: now},
+	}
+
+	gDB.AddDeviceLocations(&gTestDevices[0], fixes)
+	for _, l := range fixes {
+		if err := geocodeLocation(gDB, geocoder, &gTestDevices[0], l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both fixes are in the same cached area
+	if calls != 1 {
+		t.Errorf("Geocoder was called %d times", calls)
+	}
+
+	device, _ := gDB.GetDeviceById(gTestDevices[0].Id)
+	if device.Address != geocoder.address {
+		t.Errorf("Unexpected device address: %q", device.Address)
+	}
+
+	locations, _ := gDB.ListLocationsForDevice(device, 0, 0)
+	if len(locations) != 2 || locations[0].Address != geocoder.address {
+		t.Errorf("Unexpected locations: %#v", locations)
+	}
+
+	// A newer fix replaces the address until it's geocoded
+	gDB.UpdateDeviceLocation(device, Location{Latitude: 1, Longitude: 1, Timestamp: now + 1})
+	if device, _ = gDB.GetDeviceById(device.Id); device.Address != "" {
+		t.Errorf("Unexpected device address: %q", device.Address)
+	}
+
+	later := time.Now().Add(geocodeCacheLifetime + time.Hour)
+	if _, err := reverseGeocode(gDB, geocoder, "ggp@mozilla.com", 48.86061, 2.33761, later); err != nil || calls != 2 {
+		t.Errorf("Expired cache entry was used: %d calls, %v", calls, err)
+	}
+
+	// Users don't share answers
+	reverseGeocode(gDB, geocoder, "ggoncalves@mozilla.com", 48.86061, 2.33761, time.Now())
+	if calls != 3 {
+		t.Errorf("Another user's cache entry was used: %d calls", calls)
+	}
+}
+
+func TestGeocodeCachePrivacy(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	calls := 0
+	geocoder := CountingGeocoder{"Paris, FR", &calls}
+
+	// Keys can't be computed without the server's secret
+	gServerConfig.SessionCookie = "s3cr3t"
+	key := gDB.geocodeCacheKey("ggp@mozilla.com", geocoder.Name(), 48.861, 2.338)
+	gServerConfig.SessionCookie = "other"
+	if key == gDB.geocodeCacheKey("ggp@mozilla.com", geocoder.Name(), 48.861, 2.338) {
+		t.Error("Cache key doesn't depend on the secret")
+	}
+
+	countCached := func() int {
+		var count int
+		gDB.connection.QueryRow(`select count(*) from geocode_cache where user="ggp@mozilla.com"`).Scan(&count)
+		return count
+	}
+
+	fix := Location{Latitude: 48.861, Longitude: 2.338, Timestamp: time.Now().Unix()}
+	gDB.UpdateDeviceLocation(&gTestDevices[0], fix)
+	geocodeLocation(gDB, geocoder, &gTestDevices[0], fix)
+	if countCached() != 1 {
+		t.Fatal("Address wasn't cached")
+	}
+
+	// Deleting the locations forgets where they were
+	gDB.DeleteLocationsForUser("ggp@mozilla.com")
+	if countCached() != 0 {
+		t.Error("Cached addresses survived deleting the locations")
+	}
+
+	// Fixes deleted while queued aren't cached again
+	geocodeLocation(gDB, geocoder, &gTestDevices[0], fix)
+	if countCached() != 0 || calls != 1 {
+		t.Errorf("Deleted fix was geocoded: %d calls", calls)
+	}
+
+	gDB.UpdateDeviceLocation(&gTestDevices[0], fix)
+	geocodeLocation(gDB, geocoder, &gTestDevices[0], fix)
+	gDB.PruneLocations("ggp@mozilla.com", time.Now().Add(time.Hour).Unix())
+	if countCached() != 0 {
+		t.Error("Cached addresses survived pruning the locations")
+	}
+}
+
+func TestGeocodeDroppedFix(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	var latitude float64
+	geocoder := LastGeocoder{&latitude}
+
+	now := time.Now().Unix()
+	stored := Location{Latitude: 48.861, Longitude: 2.338, Timestamp: now}
+	dropped := Location{Latitude: 40.7, Longitude: -74, Timestamp: now}
+	gDB.AddDeviceLocations(&gTestDevices[0], []Location{stored})
+	gDB.AddDeviceLocations(&gTestDevices[0], []Location{dropped})
+
+	// The stored fix is geocoded, not the one dropped for the same second
+	if err := geocodeLocation(gDB, geocoder, &gTestDevices[0], dropped); err != nil {
+		t.Fatal(err)
+	}
+
+	if latitude != stored.Latitude {
+		t.Errorf("Geocoded the wrong fix: %f", latitude)
+	}
+}
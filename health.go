@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Probes shouldn't hang when the database is locked.
+const readinessTimeout = 2 * time.Second
+
+// Set once the server starts shutting down, so that load balancers stop
+// sending requests before it refuses them.
+var gShuttingDown atomic.Bool
+
+type HealthCheck struct {
+	Status string `json:"status"`
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+func (self DB) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := self.connection.QueryRowContext(ctx, `pragma user_version`).Scan(&version)
+	return version, err
+}
+
+func (self DB) CountCommands(ctx context.Context) (int, error) {
+	var count int
+	err := self.connection.QueryRowContext(ctx, `select count(*) from commands`).Scan(&count)
+	return count, err
+}
+
+func checkDatabase(ctx context.Context) error {
+	if gDB == nil {
+		return fmt.Errorf("Database is not open")
+	}
+	return gDB.connection.PingContext(ctx)
+}
+
+func checkMigrations(ctx context.Context) error {
+	if gDB == nil {
+		return fmt.Errorf("Database is not open")
+	}
+
+	version, err := gDB.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if version != len(migrations) {
+		return fmt.Errorf("Schema version is %d, expected %d", version, len(migrations))
+	}
+	return nil
+}
+
+func checkCommands(ctx context.Context) error {
+	if gDB == nil {
+		return fmt.Errorf("Database is not open")
+	}
+
+	count, err := gDB.CountCommands(ctx)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return fmt.Errorf("No commands are loaded")
+	}
+	return nil
+}
+
+// CheckPushEndpoints opens an endpoint sealed with each key id, which
+// fails when its key is no longer configured.
+func (self DB) CheckPushEndpoints(ctx context.Context) error {
+	rows, err := self.connection.QueryContext(ctx,
+		`select id, endpoint from devices where endpoint like "enc%"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	checked := map[string]bool{}
+	for rows.Next() {
+		var id int64
+		var endpoint string
+		if err = rows.Scan(&id, &endpoint); err != nil {
+			return err
+		}
+
+		// The prefix and key id
+		keyId := endpoint[:strings.LastIndex(endpoint, ":")+1]
+		if checked[keyId] {
+			continue
+		}
+		checked[keyId] = true
+
+		if _, err = self.openString("endpoint", deviceRow(id), endpoint); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Commands can't be pushed to devices whose endpoint can't be decrypted.
+func checkPush(ctx context.Context) error {
+	if gDB == nil {
+		return fmt.Errorf("Database is not open")
+	}
+	return gDB.CheckPushEndpoints(ctx)
+}
+
+func checkShutdown(ctx context.Context) error {
+	if gShuttingDown.Load() {
+		return fmt.Errorf("Server is shutting down")
+	}
+	return nil
+}
+
+var gReadinessChecks = map[string]func(context.Context) error{
+	"database":   checkDatabase,
+	"migrations": checkMigrations,
+	"commands":   checkCommands,
+	"push":       checkPush,
+	"shutdown":   checkShutdown,
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, health HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
+
+// serveHealthz only tells that the process is alive and serving.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// serveReadyz tells whether the server can handle requests, with the
+// outcome of every check. Probes are public, so why a check failed is
+// only logged.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	health := HealthResponse{Status: "ok", Checks: map[string]HealthCheck{}}
+	status := http.StatusOK
+
+	for name, check := range gReadinessChecks {
+		if err := check(ctx); err != nil {
+			slog.ErrorContext(r.Context(), "Readiness check failed", "check", name, "error", err)
+			health.Checks[name] = HealthCheck{Status: "failed"}
+			health.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		} else {
+			health.Checks[name] = HealthCheck{Status: "ok"}
+		}
+	}
+
+	writeHealthResponse(w, status, health)
+}
+
+// Probes don't require a login.
+func setupHealthHandlers() {
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", serveReadyz)
+}
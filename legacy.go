@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/emicklei/go-restful"
+	"strings"
+)
+
+// Older clients, and the devices already deployed, expect the fields of
+// devices, commands and invocations capitalized, as they were before the
+// API types had working json tags. They still get that format from the
+// unversioned routes, and from the versioned API by asking for it:
+//
+//	Accept: application/vnd.whereismyfox.legacy+json
+//
+// Requests are accepted in either format, as field names are matched
+// regardless of case.
+const legacyMIME = "application/vnd.whereismyfox.legacy+json"
+
+// The legacy types have the same fields as the current ones, in the same
+// order, so that they convert into each other; only their tags differ.
+
+type legacyDevice struct {
+	User      string
+	Id        int64
+	Name      string
+	Endpoint  string
+	Latitude  float64
+	Longitude float64
+	Timestamp string
+
+	Accuracy *float64 `json:"accuracy,omitempty"`
+	Altitude *float64 `json:"altitude,omitempty"`
+	Speed    *float64 `json:"speed,omitempty"`
+	Heading  *float64 `json:"heading,omitempty"`
+	Provider string   `json:"provider,omitempty"`
+	Battery  *float64 `json:"battery,omitempty"`
+
+	Address string `json:"address,omitempty"`
+}
+
+type legacyCommandResponse struct {
+	Name        string
+	Description string
+	Trigger     string
+	Destructive bool `json:"destructive"`
+}
+
+type legacyCommandContext struct {
+	CommandId int64
+	Arguments map[string]bool
+}
+
+type legacyDevicePage struct {
+	Items []legacyDevice `json:"items"`
+	Pagination
+}
+
+type legacyCommandPage struct {
+	Items []legacyCommandResponse `json:"items"`
+	Pagination
+}
+
+func toLegacyDevices(devices []Device) []legacyDevice {
+	legacy := make([]legacyDevice, len(devices))
+	for i, device := range devices {
+		legacy[i] = legacyDevice(device)
+	}
+	return legacy
+}
+
+func toLegacyCommandResponses(responses []CommandResponse) []legacyCommandResponse {
+	legacy := make([]legacyCommandResponse, len(responses))
+	for i, response := range responses {
+		legacy[i] = legacyCommandResponse(response)
+	}
+	return legacy
+}
+
+// toLegacy returns the legacy form of v, or v itself when its format
+// never changed.
+func toLegacy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Device:
+		return legacyDevice(v)
+	case []Device:
+		return toLegacyDevices(v)
+	case CommandResponse:
+		return legacyCommandResponse(v)
+	case []CommandResponse:
+		return toLegacyCommandResponses(v)
+	case CommandContext:
+		return legacyCommandContext(v)
+	case DevicePage:
+		return legacyDevicePage{toLegacyDevices(v.Items), v.Pagination}
+	case CommandPage:
+		return legacyCommandPage{toLegacyCommandResponses(v.Items), v.Pagination}
+	}
+	return v
+}
+
+func wantsLegacyJSON(request *restful.Request) bool {
+	return strings.Contains(request.HeaderParameter("Accept"), legacyMIME)
+}
+
+// writeEntity writes v in the format the client expects, see legacyMIME.
+func writeEntity(request *restful.Request, response *restful.Response, status int, v interface{}) {
+	switch {
+	case wantsLegacyJSON(request):
+		response.WriteHeaderAndJson(status, toLegacy(v), legacyMIME)
+	case !isVersionedAPI(request):
+		response.WriteHeaderAndJson(status, toLegacy(v), restful.MIME_JSON)
+	default:
+		response.WriteHeaderAndEntity(status, v)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "reflect"
+import "sort"
+import "testing"
+
+func jsonKeys(t *testing.T, data []byte) []string {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestJSONFieldNames(t *testing.T) {
+	accuracy := 12.5
+	values := []struct {
+		value interface{}
+		keys  []string
+	}{
+		{
+			&Device{"ggp@mozilla.com", 1, "phone", "http://push.example.com/1", 1.5, 2.5, "2014-01-01", &accuracy, nil, nil, nil, "gps", nil, "Paris, FR"},
+			[]string{"accuracy", "address", "endpoint", "id", "latitude", "longitude", "name", "provider", "timestamp"},
+		},
+		{
+			&Command{1, "Ring", "Ring the device", false},
+			[]string{"description", "destructive", "id", "name"},
+		},
+		{
+			&CommandContext{3, map[string]bool{"loud": true}},
+			[]string{"arguments", "commandId"},
+		},
+		{
+			&CommandResponse{"Ring", "Ring the device", "/api/v1/device/1/command/1", false},
+			[]string{"description", "destructive", "name", "trigger"},
+		},
+		{
+			&PersonaResponse{"okay", "ggp@mozilla.com", "http://localhost", 1, "login.persona.org", ""},
+			[]string{"audience", "email", "expires", "issuer", "status"},
+		},
+	}
+
+	for _, v := range values {
+		data, err := json.Marshal(v.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if keys := jsonKeys(t, data); !reflect.DeepEqual(keys, v.keys) {
+			t.Errorf("Unexpected fields for %T: %v", v.value, keys)
+		}
+
+		result := reflect.New(reflect.TypeOf(v.value).Elem()).Interface()
+		if err := json.Unmarshal(data, result); err != nil {
+			t.Fatal(err)
+		}
+
+		// The owner of a device is never sent to clients
+		if device, ok := v.value.(*Device); ok {
+			expected := *device
+			expected.User = ""
+			v.value = &expected
+		}
+
+		if !reflect.DeepEqual(result, v.value) {
+			t.Errorf("Round trip mismatch: %#v != %#v", result, v.value)
+		}
+	}
+}
+
+func TestLegacyJSON(t *testing.T) {
+	device := Device{"ggp@mozilla.com", 1, "phone", "http://push.example.com/1", 1.5, 2.5, "2014-01-01", nil, nil, nil, nil, "", nil, ""}
+
+	data, _ := json.Marshal(toLegacy(device))
+	expected := []string{"Endpoint", "Id", "Latitude", "Longitude", "Name", "Timestamp", "User"}
+	if keys := jsonKeys(t, data); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected legacy fields: %v", keys)
+	}
+
+	// Old clients sending capitalized fields are still understood
+	result := Device{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	device.User = ""
+	if result != device {
+		t.Errorf("Mismatch in legacy device: %#v != %#v", result, device)
+	}
+
+	data, _ = json.Marshal(toLegacy(CommandContext{3, nil}))
+	if keys := jsonKeys(t, data); !reflect.DeepEqual(keys, []string{"Arguments", "CommandId"}) {
+		t.Errorf("Unexpected legacy invocation fields: %v", keys)
+	}
+}
+
+func TestLegacyContentNegotiation(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	get := func(url, accept string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest("GET", url, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+
+		response := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("Unexpected response code for %s: %d", url, response.Code)
+		}
+		return response
+	}
+
+	if keys := jsonKeys(t, get("/api/v1/device/1", "").Body.Bytes()); keys[0] != "endpoint" {
+		t.Errorf("Unexpected fields: %v", keys)
+	}
+
+	response := get("/api/v1/device/1", legacyMIME)
+	if keys := jsonKeys(t, response.Body.Bytes()); keys[0] != "Endpoint" {
+		t.Errorf("Unexpected legacy fields: %v", keys)
+	}
+
+	if contentType := response.Header().Get("Content-Type"); contentType != legacyMIME {
+		t.Errorf("Unexpected content type: %s", contentType)
+	}
+
+	if keys := jsonKeys(t, get("/device/1", "").Body.Bytes()); keys[0] != "Endpoint" {
+		t.Errorf("Unexpected fields on unversioned route: %v", keys)
+	}
+
+	page := legacyCommandPage{}
+	json.Unmarshal(get("/api/v1/device/1/command", legacyMIME).Body.Bytes(), &page)
+	if len(page.Items) == 0 || page.Items[0].Trigger == "" {
+		t.Errorf("Unexpected legacy page of commands: %#v", page)
+	}
+}
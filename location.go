@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A location fix as reported by a device. Everything but the coordinates
+// is optional, as not every provider can tell the altitude, speed or
+// heading. Timestamp is the time of the fix on the device, in seconds
+// since the epoch. Address is filled in by the server, see Geocoder.
+type Location struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Accuracy  *float64 `json:"accuracy,omitempty"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+	Speed     *float64 `json:"speed,omitempty"`
+	Heading   *float64 `json:"heading,omitempty"`
+	Provider  string   `json:"provider,omitempty"`
+	Battery   *float64 `json:"battery,omitempty"`
+	Timestamp int64    `json:"timestamp"`
+	Address   string   `json:"address,omitempty"`
+}
+
+var gLocationProviders = map[string]bool{
+	"":        true,
+	"gps":     true,
+	"wifi":    true,
+	"cell":    true,
+	"network": true,
+}
+
+// Devices' clocks are not always right, but fixes from the future are
+// surely bogus.
+const maxClockSkew = 5 * time.Minute
+
+// Devices buffer fixes while offline and upload them in batches, but
+// there's no reason for a batch to be arbitrarily large.
+const maxLocationBatch = 1000
+
+type LocationBatchResponse struct {
+	Received int `json:"received"`
+	Stored   int `json:"stored"`
+}
+
+// LocationBatchError tells which fix of a batch is invalid.
+type LocationBatchError struct {
+	Index int
+	Err   error
+}
+
+func (self LocationBatchError) Error() string {
+	return fmt.Sprintf("Location %d: %s", self.Index, self.Err)
+}
+
+func checkRange(name string, value *float64, min, max float64) error {
+	if value == nil {
+		return nil
+	}
+
+	if math.IsNaN(*value) || math.IsInf(*value, 0) {
+		return fmt.Errorf("Invalid %s", name)
+	}
+
+	if *value < min || *value > max {
+		return fmt.Errorf("%s out of range", name)
+	}
+
+	return nil
+}
+
+func (self Location) Validate() error {
+	checks := []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"latitude", &self.Latitude, -90, 90},
+		{"longitude", &self.Longitude, -180, 180},
+		{"accuracy", self.Accuracy, 0, math.MaxFloat64},
+		{"altitude", self.Altitude, -12000, 100000},
+		{"speed", self.Speed, 0, math.MaxFloat64},
+		{"heading", self.Heading, 0, 360},
+		{"battery", self.Battery, 0, 100},
+	}
+
+	for _, check := range checks {
+		if err := checkRange(check.name, check.value, check.min, check.max); err != nil {
+			return err
+		}
+	}
+
+	if !gLocationProviders[self.Provider] {
+		return fmt.Errorf("Unknown provider %s", self.Provider)
+	}
+
+	if self.Timestamp <= 0 {
+		return fmt.Errorf("Invalid timestamp")
+	}
+
+	if time.Unix(self.Timestamp, 0).After(time.Now().Add(maxClockSkew)) {
+		return fmt.Errorf("Timestamp is in the future")
+	}
+
+	return nil
+}
+
+// sortLocationBatch validates every fix in a batch, and returns them
+// ordered by time with duplicates removed. A device can't be in two
+// places at once, so fixes with the same timestamp are duplicates.
+// Unlike single reports, fixes in a batch must carry their own timestamp.
+func sortLocationBatch(locations []Location) ([]Location, error) {
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("No locations")
+	}
+
+	if len(locations) > maxLocationBatch {
+		return nil, fmt.Errorf("Too many locations, at most %d are allowed", maxLocationBatch)
+	}
+
+	for i, l := range locations {
+		if err := l.Validate(); err != nil {
+			return nil, LocationBatchError{i, err}
+		}
+	}
+
+	sorted := make([]Location, len(locations))
+	copy(sorted, locations)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	unique := sorted[:0]
+	for _, l := range sorted {
+		if n := len(unique); n > 0 && unique[n-1].Timestamp == l.Timestamp {
+			continue
+		}
+		unique = append(unique, l)
+	}
+
+	return unique, nil
+}
+
+func parseOptionalFloat(r *http.Request, name string) (*float64, error) {
+	str := r.FormValue(name)
+	if str == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s", name)
+	}
+
+	return &value, nil
+}
+
+// parseLocationForm reads a location from the request's query or form
+// parameters. The fix is stamped with the current time unless the
+// device provided its own timestamp.
+func parseLocationForm(r *http.Request) (Location, error) {
+	location := Location{
+		Provider:  r.FormValue("provider"),
+		Timestamp: time.Now().Unix(),
+	}
+
+	var err error
+	location.Latitude, err = strconv.ParseFloat(r.FormValue("latitude"), 64)
+	if err != nil {
+		return location, fmt.Errorf("Failed to parse latitude")
+	}
+
+	location.Longitude, err = strconv.ParseFloat(r.FormValue("longitude"), 64)
+	if err != nil {
+		return location, fmt.Errorf("Failed to parse longitude")
+	}
+
+	optional := []struct {
+		name  string
+		value **float64
+	}{
+		{"accuracy", &location.Accuracy},
+		{"altitude", &location.Altitude},
+		{"speed", &location.Speed},
+		{"heading", &location.Heading},
+		{"battery", &location.Battery},
+	}
+
+	for _, param := range optional {
+		if *param.value, err = parseOptionalFloat(r, param.name); err != nil {
+			return location, err
+		}
+	}
+
+	if str := r.FormValue("timestamp"); str != "" {
+		location.Timestamp, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return location, fmt.Errorf("Failed to parse timestamp")
+		}
+	}
+
+	return location, nil
+}
+
+func (self DB) ListLocationsForDevice(device *Device, from, to int64) ([]Location, error) {
+	query := `select latitude, longitude, accuracy, altitude, speed, heading,
+		provider, battery, timestamp, address from locations where device_id=?`
+	args := []interface{}{device.Id}
+
+	if from != 0 {
+		query += " and timestamp>=?"
+		args = append(args, from)
+	}
+
+	if to != 0 {
+		query += " and timestamp<=?"
+		args = append(args, to)
+	}
+
+	res, err := self.connection.Query(query+" order by timestamp", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	locations := make([]Location, 0)
+	for res.Next() {
+		l := Location{}
+		var latitude, longitude, address string
+		err = res.Scan(&latitude, &longitude, &l.Accuracy, &l.Altitude,
+			&l.Speed, &l.Heading, &l.Provider, &l.Battery, &l.Timestamp, &address)
+		if err != nil {
+			return nil, err
+		}
+
+		row := locationRow(device.Id, l.Timestamp)
+		if l.Latitude, err = self.openFloat("latitude", row, latitude); err != nil {
+			return nil, err
+		}
+
+		if l.Longitude, err = self.openFloat("longitude", row, longitude); err != nil {
+			return nil, err
+		}
+
+		if l.Address, err = self.openString("address", row, address); err != nil {
+			return nil, err
+		}
+
+		locations = append(locations, l)
+	}
+
+	return locations, res.Err()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type requestIdKey struct{}
+
+// Proxies in front of the server may already have assigned an id.
+const requestIdHeader = "X-Request-Id"
+
+// requestIdHandler adds the id of the request being served, if any, to
+// records logged with a context.
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (self requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIdKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return self.Handler.Handle(ctx, record)
+}
+
+func (self requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{self.Handler.WithAttrs(attrs)}
+}
+
+func (self requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{self.Handler.WithGroup(name)}
+}
+
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return nil, fmt.Errorf("logLevel %q is not one of debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: l}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("logFormat %q is not one of json or text", format)
+	}
+
+	return slog.New(requestIdHandler{handler}), nil
+}
+
+// setupLogging sends every record, including those of the standard log
+// package, to standard error in the configured format.
+func setupLogging(config ServerConfig) error {
+	logger, err := newLogger(os.Stderr, config.LogLevel, config.LogFormat)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(logger)
+	return nil
+}
+
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Only ids that are safe to log are accepted from the client.
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *statusRecorder) Write(data []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	n, err := self.ResponseWriter.Write(data)
+	self.bytes += n
+	return n, err
+}
+
+// withRequestLogging gives every request an id, returned in the
+// X-Request-Id header and attached to everything logged while serving it,
+// and logs a record once the request is served. The restful container is
+// served from http.DefaultServeMux, so wrapping the latter covers both.
+func withRequestLogging(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+
+		w.Header().Set(requestIdHeader, id)
+		ctx := context.WithValue(r.Context(), requestIdKey{}, id)
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		start := time.Now()
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// Probes would drown everything else
+		level := slog.LevelInfo
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			level = slog.LevelDebug
+		}
+
+		slog.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"source_ip", sourceIP(r))
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/emicklei/go-restful"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sessions count as active while their user made a request recently.
+const activeSessionWindow = 15 * time.Minute
+
+var (
+	gRequestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_http_requests_total",
+		Help: "Requests to the web services, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	gRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whereismyfox_http_request_duration_seconds",
+		Help:    "Time spent serving requests to the web services, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	gPushCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_push_attempts_total",
+		Help: "Push notifications sent to devices, by transport.",
+	}, []string{"transport"})
+
+	gPushFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_push_failures_total",
+		Help: "Push notifications that could not be delivered, by transport.",
+	}, []string{"transport"})
+
+	gLocationReports = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_location_reports_total",
+		Help: "Location reports received from devices, by kind (single or batch).",
+	}, []string{"kind"})
+
+	gGeocodeLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_geocode_lookups_total",
+		Help: "Addresses looked up for reported locations, by provider and outcome (cached, found, none or error).",
+	}, []string{"provider", "outcome"})
+
+	gRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "whereismyfox_rate_limited_total",
+		Help: "Requests rejected for exceeding a rate limit, by route class.",
+	}, []string{"class"})
+
+	gQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whereismyfox_db_query_duration_seconds",
+		Help:    "Time spent executing database statements, by operation (exec or query).",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+
+	gPendingInvocations = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "whereismyfox_pending_invocations",
+		Help: "Commands pushed to devices whose invocation wasn't fetched yet.",
+	}, func() float64 {
+		if gDB == nil {
+			return 0
+		}
+
+		count, _ := gDB.CountInvocations()
+		return float64(count)
+	})
+
+	gActiveSessions = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "whereismyfox_active_sessions",
+		Help: "Logged in users who made a request in the last 15 minutes.",
+	}, func() float64 {
+		return float64(gSessionActivity.active(time.Now()))
+	})
+)
+
+// sessionActivity remembers when each logged in user was last seen.
+type sessionActivity struct {
+	lock     sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+var gSessionActivity = &sessionActivity{lastSeen: map[string]time.Time{}}
+
+func (self *sessionActivity) seen(user string, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastSeen[user] = now
+}
+
+// active also forgets users who haven't been seen within the window.
+func (self *sessionActivity) active(now time.Time) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for user, lastSeen := range self.lastSeen {
+		if now.Sub(lastSeen) > activeSessionWindow {
+			delete(self.lastSeen, user)
+		}
+	}
+
+	return len(self.lastSeen)
+}
+
+// observeRequest is installed on every web service rather than on the
+// container, as only then is the route known.
+func observeRequest(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	start := time.Now()
+	chain.ProcessFilter(request, response)
+
+	route := request.SelectedRoutePath()
+	method := request.Request.Method
+	code := strconv.Itoa(response.StatusCode())
+
+	gRequestCount.WithLabelValues(route, method, code).Inc()
+	gRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+}
+
+// timedDriver wraps the SQLite driver to measure how long statements take.
+type timedDriver struct {
+	driver.Driver
+}
+
+const timedSQLiteDriver = "sqlite3-timed"
+
+func init() {
+	sql.Register(timedSQLiteDriver, timedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+func (self timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := self.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{conn}, nil
+}
+
+type timedConn struct {
+	driver.Conn
+}
+
+func (self timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if conn, ok := self.Conn.(driver.ConnBeginTx); ok {
+		return conn.BeginTx(ctx, opts)
+	}
+	return self.Conn.Begin()
+}
+
+func (self timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn, ok := self.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer observeQuery("exec", time.Now())
+	return conn.ExecContext(ctx, query, args)
+}
+
+func (self timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn, ok := self.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	defer observeQuery("query", time.Now())
+	return conn.QueryContext(ctx, query, args)
+}
+
+func observeQuery(operation string, start time.Time) {
+	gQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func setupMetricsHandlers() {
+	prometheus.MustRegister(gRequestCount, gRequestDuration, gPushCount, gPushFailures,
+		gLocationReports, gGeocodeLookups, gRateLimited, gQueryDuration, gPendingInvocations, gActiveSessions)
+
+	http.Handle("/metrics", promhttp.Handler())
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An OpenAPI 3 document describing the web services, built from the
+// documentation attached to their routes.
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Description string                      `json:"description,omitempty"`
+	Required    bool                        `json:"required,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationId string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+
+	// Overrides the document's security when set. Empty for public routes.
+	Security *[]map[string][]string `json:"security,omitempty"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema        `json:"schemas"`
+	SecuritySchemes map[string]openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+const apiVersion = "1.0"
+
+// Path parameters may carry a regular expression, e.g. {track:track\.gpx},
+// which OpenAPI doesn't know about.
+var pathParameterExpr = regexp.MustCompile(`\{([^}:]+):[^}]*\}`)
+
+// schemaBuilder turns Go types into schemas, collecting named structs as
+// components so that they are only described once.
+type schemaBuilder struct {
+	components map[string]*openAPISchema
+}
+
+func (self schemaBuilder) schemaFor(t reflect.Type) *openAPISchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := self.schemaFor(t.Elem())
+		if schema.Ref != "" {
+			return schema
+		}
+		nullable := *schema
+		nullable.Nullable = true
+		return &nullable
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: self.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: self.schemaFor(t.Elem())}
+	case reflect.Struct:
+		return self.structSchema(t)
+	}
+
+	return &openAPISchema{}
+}
+
+// structSchema describes fields the way encoding/json marshals them.
+func (self schemaBuilder) structSchema(t reflect.Type) *openAPISchema {
+	ref := &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	if _, exists := self.components[t.Name()]; exists {
+		return ref
+	}
+
+	schema := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+	self.components[t.Name()] = schema
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		omitempty := false
+		for _, option := range tag[1:] {
+			omitempty = omitempty || option == "omitempty"
+		}
+
+		schema.Properties[name] = self.schemaFor(field.Type)
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return ref
+}
+
+func (self schemaBuilder) content(sample interface{}, mimeTypes []string) map[string]openAPIMediaType {
+	schema := self.schemaFor(reflect.TypeOf(sample))
+
+	content := map[string]openAPIMediaType{}
+	for _, mimeType := range mimeTypes {
+		// Only kept for older clients, see legacyMIME
+		if mimeType == legacyMIME {
+			continue
+		}
+
+		if mimeType == restful.MIME_JSON {
+			content[mimeType] = openAPIMediaType{schema}
+		} else {
+			content[mimeType] = openAPIMediaType{&openAPISchema{Type: "string"}}
+		}
+	}
+
+	return content
+}
+
+func parameterSchema(data restful.ParameterData) *openAPISchema {
+	switch data.DataType {
+	case "integer":
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case "number":
+		return &openAPISchema{Type: "number", Format: "double"}
+	case "boolean":
+		return &openAPISchema{Type: "boolean"}
+	}
+	return &openAPISchema{Type: "string"}
+}
+
+func (self schemaBuilder) operation(ws *restful.WebService, route restful.Route) *openAPIOperation {
+	operation := &openAPIOperation{
+		OperationId: route.Operation,
+		Summary:     route.Doc,
+		Description: route.Notes,
+		Tags:        []string{path.Base(ws.RootPath())},
+		Responses:   map[string]openAPIResponse{},
+		Deprecated:  route.Deprecated,
+	}
+
+	form := &openAPISchema{Type: "object", Properties: map[string]*openAPISchema{}}
+
+	for _, param := range route.ParameterDocs {
+		data := param.Data()
+		switch data.Kind {
+		case restful.PathParameterKind, restful.QueryParameterKind, restful.HeaderParameterKind:
+			in := map[int]string{
+				restful.PathParameterKind:   "path",
+				restful.QueryParameterKind:  "query",
+				restful.HeaderParameterKind: "header",
+			}[data.Kind]
+
+			operation.Parameters = append(operation.Parameters, openAPIParameter{
+				Name:        data.Name,
+				In:          in,
+				Description: data.Description,
+				Required:    data.Required || data.Kind == restful.PathParameterKind,
+				Schema:      parameterSchema(data),
+			})
+		case restful.FormParameterKind:
+			form.Properties[data.Name] = parameterSchema(data)
+			if data.Required {
+				form.Required = append(form.Required, data.Name)
+			}
+		case restful.BodyParameterKind:
+			operation.RequestBody = &openAPIRequestBody{
+				Description: data.Description,
+				Required:    data.Required,
+				Content:     self.content(route.ReadSample, route.Consumes),
+			}
+		}
+	}
+
+	if len(form.Properties) != 0 {
+		operation.RequestBody = &openAPIRequestBody{
+			Required: len(form.Required) != 0,
+			Content: map[string]openAPIMediaType{
+				"application/x-www-form-urlencoded": {form},
+			},
+		}
+	}
+
+	for code, response := range route.ResponseErrors {
+		r := openAPIResponse{Description: response.Message}
+		if response.Model != nil {
+			r.Content = self.content(response.Model, route.Produces)
+		}
+		operation.Responses[strconv.Itoa(code)] = r
+	}
+
+	// Routes only documenting errors, if any, succeed with a 200
+	succeeds := false
+	for code := range route.ResponseErrors {
+		succeeds = succeeds || code < 300
+	}
+
+	if !succeeds {
+		r := openAPIResponse{Description: "OK"}
+		if route.WriteSample != nil {
+			r.Content = self.content(route.WriteSample, route.Produces)
+		}
+		operation.Responses["200"] = r
+	}
+
+	switch route.Metadata[routeAuthMetadata] {
+	case authDeviceToken:
+		operation.Security = &[]map[string][]string{{"session": {}}, {"deviceToken": {}}}
+	case authNone:
+		operation.Security = &[]map[string][]string{}
+	}
+
+	// Only versioned routes are documented, and they report errors as JSON
+	operation.Responses["default"] = openAPIResponse{
+		Description: "Error",
+		Content:     self.content(APIErrorResponse{}, []string{restful.MIME_JSON}),
+	}
+
+	return operation
+}
+
+// buildOpenAPIDocument describes the web services under root, which
+// becomes the server URL.
+func buildOpenAPIDocument(services []*restful.WebService, root string) openAPIDocument {
+	builder := schemaBuilder{map[string]*openAPISchema{}}
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       "Where Is My Fox?",
+			Description: "Locate and control your devices",
+			Version:     apiVersion,
+		},
+		Servers: []openAPIServer{{root}},
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: builder.components,
+			SecuritySchemes: map[string]openAPISecurityScheme{
+				"session":     {Type: "apiKey", In: "cookie", Name: sessionCookieName},
+				"deviceToken": {Type: "http", Scheme: "bearer"},
+			},
+		},
+		Security: []map[string][]string{{"session": {}}},
+	}
+
+	for _, ws := range services {
+		if !strings.HasPrefix(ws.RootPath(), root+"/") {
+			continue
+		}
+
+		for _, route := range ws.Routes() {
+			routePath := strings.TrimPrefix(pathParameterExpr.ReplaceAllString(route.Path, "{$1}"), root)
+			if doc.Paths[routePath] == nil {
+				doc.Paths[routePath] = map[string]*openAPIOperation{}
+			}
+			doc.Paths[routePath][strings.ToLower(route.Method)] = builder.operation(ws, route)
+		}
+	}
+
+	return doc
+}
+
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	services := restful.RegisteredWebServices()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].RootPath() < services[j].RootPath()
+	})
+
+	w.Header().Set("Content-Type", restful.MIME_JSON)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(buildOpenAPIDocument(services, apiV1Root))
+}
+
+func setupAPIDocsHandlers() {
+	http.HandleFunc("/apidocs.json", serveAPIDocs)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Devices are paired without logging in on them: a logged in user asks
+// for a short pairing code, shown in the web interface as digits and as a
+// QR code, and the device sends it back along with its name and push
+// endpoint. The device is then added for that user, and gets a token to
+// authenticate its own requests with, as "Authorization: Bearer <token>".
+// Tokens are only accepted on the routes devices need, and only for the
+// device they were issued to.
+//
+// Codes are only guessed from few addresses: after pairingMaxFailures
+// failed attempts within a code's lifetime, an address can't pair for a
+// while. Other addresses, and outstanding codes, aren't affected.
+const (
+	pairingCodeLifetime = 10 * time.Minute
+	pairingCodeDigits   = 6
+	pairingMaxFailures  = 10
+	pairingLockout      = 10 * time.Minute
+)
+
+// Route metadata telling who may call a route besides logged in users.
+const (
+	routeAuthMetadata = "auth"
+	authDeviceToken   = "deviceToken"
+	authNone          = "none"
+)
+
+const tokenDeviceAttribute = "tokenDevice"
+
+type PairingCode struct {
+	Code    string
+	User    string
+	Expires time.Time
+}
+
+type PairingCodeResponse struct {
+	Code    string `json:"code"`
+	Expires int64  `json:"expires"`
+
+	// Where the device sends the code
+	Pair string `json:"pair"`
+
+	// What the QR code shown to the device encodes
+	Payload string `json:"payload"`
+}
+
+type PairingRequest struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+}
+
+type PairingResponse struct {
+	Device Device `json:"device"`
+
+	// Only ever returned here, the server keeps a hash
+	Token string `json:"token"`
+}
+
+// Codes by value. A user only has one code at a time.
+var gPairingCodes = map[string]*PairingCode{}
+var gPairingCodesLock sync.Mutex
+
+// Failed attempts of a source address since a time, and until when it
+// can't pair after too many.
+type pairingFailures struct {
+	count       int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// Failures by source address. Guarded by gPairingCodesLock.
+var gPairingFailures = map[string]*pairingFailures{}
+
+var errPairingLocked = errors.New("Pairing is locked after too many failed attempts")
+
+// pairingRetryAfter is how long pairing stays locked for the source
+// address, zero if it isn't.
+func pairingRetryAfter(source string, now time.Time) time.Duration {
+	gPairingCodesLock.Lock()
+	defer gPairingCodesLock.Unlock()
+
+	if failures := gPairingFailures[source]; failures != nil && now.Before(failures.lockedUntil) {
+		return failures.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// failPairing counts a failed attempt from the source address, locking
+// it once there were too many. Called with gPairingCodesLock held.
+func failPairing(source string, now time.Time) {
+	for address, f := range gPairingFailures {
+		if now.Sub(f.since) > pairingCodeLifetime && now.After(f.lockedUntil) {
+			delete(gPairingFailures, address)
+		}
+	}
+
+	failures := gPairingFailures[source]
+	if failures == nil {
+		failures = &pairingFailures{since: now}
+		gPairingFailures[source] = failures
+	}
+
+	failures.count++
+	if failures.count < pairingMaxFailures {
+		return
+	}
+
+	slog.Warn("Pairing locked after too many failed attempts",
+		"source_ip", source,
+		"failures", failures.count)
+
+	failures.count = 0
+	failures.since = now
+	failures.lockedUntil = now.Add(pairingLockout)
+}
+
+func randomPairingCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < pairingCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", pairingCodeDigits, n), nil
+}
+
+func newPairingCode(user string, now time.Time) (*PairingCode, error) {
+	gPairingCodesLock.Lock()
+	defer gPairingCodesLock.Unlock()
+
+	for code, p := range gPairingCodes {
+		if now.After(p.Expires) || p.User == user {
+			delete(gPairingCodes, code)
+		}
+	}
+
+	for {
+		code, err := randomPairingCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := gPairingCodes[code]; !exists {
+			pairing := &PairingCode{code, user, now.Add(pairingCodeLifetime)}
+			gPairingCodes[code] = pairing
+			return pairing, nil
+		}
+	}
+}
+
+// takePairingCode returns the pairing for the code sent from the source
+// address, which can't be used again, or nil if it doesn't exist or
+// expired.
+func takePairingCode(code, source string, now time.Time) (*PairingCode, error) {
+	gPairingCodesLock.Lock()
+	defer gPairingCodesLock.Unlock()
+
+	if failures := gPairingFailures[source]; failures != nil && now.Before(failures.lockedUntil) {
+		return nil, errPairingLocked
+	}
+
+	pairing, exists := gPairingCodes[code]
+	if !exists {
+		failPairing(source, now)
+		return nil, nil
+	}
+
+	delete(gPairingCodes, code)
+	if now.After(pairing.Expires) {
+		failPairing(source, now)
+		return nil, nil
+	}
+	return pairing, nil
+}
+
+func writePairingLocked(request *restful.Request, response *restful.Response) {
+	retryAfter := int(math.Ceil(pairingRetryAfter(sourceIP(request.Request), time.Now()).Seconds()))
+	response.AddHeader("Retry-After", strconv.Itoa(retryAfter))
+	writeError(request, response, http.StatusTooManyRequests, ErrPairingLocked,
+		fmt.Sprintf("Pairing is locked after too many failed attempts, retry in %d seconds", retryAfter))
+}
+
+func removePairingCodesForUser(user string) {
+	gPairingCodesLock.Lock()
+	defer gPairingCodesLock.Unlock()
+
+	for code, p := range gPairingCodes {
+		if p.User == user {
+			delete(gPairingCodes, code)
+		}
+	}
+}
+
+func (self DB) SetDeviceToken(id int64, token string) error {
+	_, err := self.connection.Exec(
+		`update devices set token_hash=? where id=?`, hashSessionToken(token), id)
+
+	return err
+}
+
+// GetDeviceByToken returns nil if no device has the token.
+func (self DB) GetDeviceByToken(token string) (*Device, error) {
+	row := self.connection.QueryRow(
+		`select `+deviceColumns+` from devices where token_hash=?`, hashSessionToken(token))
+
+	device, err := self.scanDevice(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return device, err
+}
+
+func routeAuth(request *restful.Request) string {
+	auth, _ := request.SelectedRoute().Metadata()[routeAuthMetadata].(string)
+	return auth
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+// authenticateDevice accepts a device token on the routes meant for
+// devices, remembering the device for the handlers.
+func authenticateDevice(request *restful.Request) bool {
+	token := bearerToken(request.Request)
+	if token == "" || routeAuth(request) != authDeviceToken {
+		return false
+	}
+
+	device, err := gDB.GetDeviceByToken(token)
+	if err != nil || device == nil {
+		return false
+	}
+
+	request.SetAttribute(tokenDeviceAttribute, device)
+	return true
+}
+
+// tokenDevice is the device authenticated by its token, or nil when a
+// user is logged in.
+func tokenDevice(request *restful.Request) *Device {
+	device, _ := request.Attribute(tokenDeviceAttribute).(*Device)
+	return device
+}
+
+// requestUser is the user the request acts for: the one logged in, or
+// the owner of the device authenticated by its token.
+func requestUser(request *restful.Request) string {
+	if device := tokenDevice(request); device != nil {
+		return device.User
+	}
+	return gPersona.GetLoginName(request.Request)
+}
+
+func pairingURL(request *restful.Request) string {
+	scheme := "http"
+	if request.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + request.Request.Host + apiRoot(request) + "/pairing/device"
+}
+
+func requestPairingCode(request *restful.Request, response *restful.Response) {
+	pairing, err := newPairingCode(gPersona.GetLoginName(request.Request), time.Now())
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to create pairing code")
+		return
+	}
+
+	pair := pairingURL(request)
+	payload := "whereismyfox:pair?" + url.Values{"url": {pair}, "code": {pairing.Code}}.Encode()
+
+	audit(request, 0, AuditPairingCode, "", nil, "ok")
+	response.WriteHeaderAndEntity(http.StatusCreated, PairingCodeResponse{
+		Code:    pairing.Code,
+		Expires: pairing.Expires.Unix(),
+		Pair:    pair,
+		Payload: payload,
+	})
+}
+
+// pairDevice is public: the pairing code stands for the login.
+func pairDevice(request *restful.Request, response *restful.Response) {
+	pairing := PairingRequest{}
+	if err := request.ReadEntity(&pairing); err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse pairing")
+		return
+	}
+
+	if pairing.Name == "" || pairing.Endpoint == "" {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "No name or endpoint")
+		return
+	}
+
+	code, err := takePairingCode(pairing.Code, sourceIP(request.Request), time.Now())
+	if err == errPairingLocked {
+		writePairingLocked(request, response)
+		return
+	}
+
+	if code == nil {
+		writeError(request, response, http.StatusNotFound, ErrPairingCodeNotFound, "Invalid or expired pairing code")
+		return
+	}
+
+	// The request acts for the user who asked for the code, and then for
+	// the device
+	request.SetAttribute(tokenDeviceAttribute, &Device{User: code.User})
+	arguments := map[string]string{"name": pairing.Name, "via": "pairing"}
+
+	device, err := gDB.AddDevice(code.User, pairing.Name, pairing.Endpoint)
+	token := newSessionToken()
+	if err == nil {
+		err = gDB.SetDeviceToken(device.Id, token)
+	}
+
+	if err != nil {
+		audit(request, 0, AuditDeviceAdd, "", arguments, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to add device")
+		return
+	}
+
+	request.SetAttribute(tokenDeviceAttribute, device)
+	audit(request, device.Id, AuditDeviceAdd, "", arguments, "ok")
+	response.AddHeader("Location", fmt.Sprintf("%s/device/%d", apiRoot(request), device.Id))
+	response.WriteHeaderAndEntity(http.StatusCreated, PairingResponse{*device, token})
+}
+
+func createPairingWebService(root string) *restful.WebService {
+	ws := new(restful.WebService)
+
+	ws.
+		Filter(withAPIRoot(root)).
+		Filter(observeRequest).
+		Path(root + "/pairing").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.
+		Route(ws.POST("").To(requestPairingCode).
+		Filter(ensureIsLoggedIn).
+		Filter(checkCSRF).
+		Filter(rateLimited(rateLimitAPI)).
+		Doc("Get a code for pairing a device with the user's account").
+		Notes(fmt.Sprintf("The code expires after %d minutes, and replaces any previous one", int(pairingCodeLifetime.Minutes()))).
+		Returns(http.StatusCreated, "The pairing code", PairingCodeResponse{}))
+
+	ws.
+		Route(ws.POST("/device").To(pairDevice).
+		Filter(rateLimited(rateLimitPairing)).
+		Metadata(routeAuthMetadata, authNone).
+		Doc("Add a device to the account which requested the pairing code").
+		Notes("The response holds the token the device authenticates with, which can't be retrieved again").
+		Reads(PairingRequest{}).
+		Returns(http.StatusCreated, "The device was added", PairingResponse{}))
+
+	return ws
+}
@@ -0,0 +1,197 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "regexp"
+import "strings"
+import "testing"
+import "time"
+import "github.com/emicklei/go-restful"
+
+func doDeviceTokenRequest(method, url, body, token string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response := httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(response, request)
+	return response
+}
+
+func pairTestDevice(t *testing.T, name, endpoint string) PairingResponse {
+	response := doWebServiceRequest("POST", "/api/v1/pairing", "{}")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code: %d %s", response.Code, response.Body.String())
+	}
+
+	code := PairingCodeResponse{}
+	json.Unmarshal(response.Body.Bytes(), &code)
+	if !regexp.MustCompile(`^[0-9]{6}$`).MatchString(code.Code) || !strings.Contains(code.Payload, "code="+code.Code) {
+		t.Errorf("Unexpected pairing code: %#v", code)
+	}
+
+	// Devices pair without logging in
+	persona := gPersona
+	gPersona = MockPersona{LoggedIn: false}
+	defer func() { gPersona = persona }()
+
+	body := fmt.Sprintf(`{"code": %q, "name": %q, "endpoint": %q}`, code.Code, name, endpoint)
+	response = doDeviceTokenRequest("POST", "/api/v1/pairing/device", body, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code: %d %s", response.Code, response.Body.String())
+	}
+
+	pairing := PairingResponse{}
+	json.Unmarshal(response.Body.Bytes(), &pairing)
+
+	// Codes are single use
+	if response := doDeviceTokenRequest("POST", "/api/v1/pairing/device", body, ""); response.Code != http.StatusNotFound {
+		t.Errorf("Pairing code was used twice: %d", response.Code)
+	}
+
+	return pairing
+}
+
+func TestPairDevice(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	pairing := pairTestDevice(t, "phone", "http://push.example.com/phone")
+	if pairing.Token == "" || pairing.Device.Name != "phone" {
+		t.Fatalf("Unexpected pairing: %#v", pairing)
+	}
+
+	device, err := gDB.GetDeviceById(pairing.Device.Id)
+	if err != nil || device.User != "ggp@mozilla.com" || device.Endpoint != "http://push.example.com/phone" {
+		t.Errorf("Unexpected device: %#v, %v", device, err)
+	}
+
+	entries, _ := gDB.ListAuditEntries(AuditFilter{Actor: "ggp@mozilla.com", DeviceId: device.Id})
+	if len(entries) != 1 || entries[0].Action != AuditDeviceAdd || !strings.Contains(entries[0].Arguments, "pairing") {
+		t.Errorf("Unexpected audit log: %#v", entries)
+	}
+
+	gPersona = MockPersona{LoggedIn: false}
+	body := `{"code": "123456", "name": "other", "endpoint": "http://push.example.com/other"}`
+	if response := doDeviceTokenRequest("POST", "/api/v1/pairing/device", body, ""); response.Code != http.StatusNotFound {
+		t.Errorf("Unknown pairing code was accepted: %d", response.Code)
+	}
+
+	if response := doWebServiceRequest("POST", "/api/v1/pairing", "{}"); response.Code != http.StatusUnauthorized {
+		t.Errorf("Pairing code was given without logging in: %d", response.Code)
+	}
+}
+
+func TestPairingCodeExpiry(t *testing.T) {
+	now := time.Now()
+	pairing, err := newPairingCode("ggp@mozilla.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaced, _ := newPairingCode("ggp@mozilla.com", now)
+	if taken, _ := takePairingCode(pairing.Code, "", now); taken != nil && pairing.Code != replaced.Code {
+		t.Error("Replaced pairing code is still valid")
+	}
+
+	if taken, _ := takePairingCode(replaced.Code, "", now.Add(pairingCodeLifetime+time.Second)); taken != nil {
+		t.Error("Expired pairing code is still valid")
+	}
+}
+
+func TestPairingLockout(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	now := time.Now()
+	pairing, err := newPairingCode("ggp@mozilla.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests in tests come from no address
+	for i := 0; i < pairingMaxFailures; i++ {
+		if _, err := takePairingCode(fmt.Sprintf("%06d", i), "", now); err != nil {
+			t.Fatalf("Pairing was locked after %d failures", i)
+		}
+	}
+
+	if _, err := takePairingCode(pairing.Code, "", now); err != errPairingLocked {
+		t.Errorf("Pairing wasn't locked: %v", err)
+	}
+
+	gPersona = MockPersona{LoggedIn: false}
+	body := fmt.Sprintf(`{"code": %q, "name": "phone", "endpoint": "http://push.example.com/phone"}`, pairing.Code)
+	response := doDeviceTokenRequest("POST", "/api/v1/pairing/device", body, "")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+		t.Errorf("Unexpected response code while locked: %d", response.Code)
+	}
+
+	// Other addresses can still pair, with the codes given before
+	if taken, err := takePairingCode(pairing.Code, "192.0.2.1", now); taken == nil || err != nil {
+		t.Errorf("Pairing code didn't survive the lock: %#v, %v", taken, err)
+	}
+
+	gPersona = MockPersona{LoggedIn: true}
+	if response := doWebServiceRequest("POST", "/api/v1/pairing", "{}"); response.Code != http.StatusCreated {
+		t.Errorf("Pairing code wasn't given while an address is locked: %d", response.Code)
+	}
+
+	later := now.Add(pairingLockout + time.Second)
+	if _, err := takePairingCode("000000", "", later); err != nil {
+		t.Errorf("Pairing is still locked: %v", err)
+	}
+}
+
+func TestDeviceToken(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	pairing := pairTestDevice(t, "phone", "http://push.example.com/phone")
+	gPersona = MockPersona{LoggedIn: false}
+
+	locations := fmt.Sprintf(`[{"latitude": 1, "longitude": 2, "timestamp": %d}]`, time.Now().Unix())
+	url := fmt.Sprintf("/api/v1/device/%d/locations", pairing.Device.Id)
+
+	if response := doDeviceTokenRequest("POST", url, locations, pairing.Token); response.Code != http.StatusOK {
+		t.Errorf("Device couldn't report its location: %d %s", response.Code, response.Body.String())
+	}
+
+	if response := doDeviceTokenRequest("POST", url, locations, "wrong"); response.Code != http.StatusUnauthorized {
+		t.Errorf("Invalid token was accepted: %d", response.Code)
+	}
+
+	// Only for itself
+	if response := doDeviceTokenRequest("POST", "/api/v1/device/1/locations", locations, pairing.Token); response.Code != http.StatusNotFound {
+		t.Errorf("Device reported another device's location: %d", response.Code)
+	}
+
+	// Only on the routes meant for devices
+	for _, url := range []string{"/api/v1/device/", fmt.Sprintf("/api/v1/device/%d", pairing.Device.Id), "/api/v1/account/sessions"} {
+		if response := doDeviceTokenRequest("GET", url, "", pairing.Token); response.Code != http.StatusUnauthorized {
+			t.Errorf("Device token was accepted for %s: %d", url, response.Code)
+		}
+	}
+
+	gDB.AddInvocation(1, 1, CommandContext{1, nil}, time.Now())
+	gDB.AddInvocation(2, pairing.Device.Id, CommandContext{2, nil}, time.Now())
+
+	if response := doDeviceTokenRequest("GET", "/api/v1/device/invocation/1", "", pairing.Token); response.Code != http.StatusNotFound {
+		t.Errorf("Device got another device's invocation: %d", response.Code)
+	}
+
+	response := doDeviceTokenRequest("GET", "/api/v1/device/invocation/2", "", pairing.Token)
+	context := CommandContext{}
+	json.Unmarshal(response.Body.Bytes(), &context)
+	if response.Code != http.StatusOK || context.CommandId != 2 {
+		t.Errorf("Unexpected invocation: %d %#v", response.Code, context)
+	}
+
+	if invocations, _ := gDB.ListInvocations(); len(invocations) != 1 {
+		t.Errorf("Unexpected invocations left: %#v", invocations)
+	}
+}
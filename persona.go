@@ -5,18 +5,19 @@ import (
 	"fmt"
 	"github.com/gorilla/sessions"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type PersonaResponse struct {
-	Status   string `json: "status"`
-	Email    string `json: "email"`
-	Audience string `json: "audience"`
-	Expires  int64  `json: "expires"`
-	Issuer   string `json: "issuer"`
-	Reason   string `json: "reason,omitempty"`
+	Status   string `json:"status"`
+	Email    string `json:"email"`
+	Audience string `json:"audience"`
+	Expires  int64  `json:"expires"`
+	Issuer   string `json:"issuer"`
+	Reason   string `json:"reason,omitempty"`
 }
 
 type PersonaHandler interface {
@@ -24,38 +25,137 @@ type PersonaHandler interface {
 	GetLoginName(r *http.Request) string
 	Login(verifierURL string, w http.ResponseWriter, r *http.Request) error
 	Logout(w http.ResponseWriter, r *http.Request)
+
+	// The id of the session making the request, see Session, or 0.
+	GetSessionId(r *http.Request) int64
+
+	// The CSRF token of the session, see checkCSRF. GetCSRFToken returns
+	// an empty string when the session has none, and IssueCSRFToken
+	// starts one.
+	GetCSRFToken(r *http.Request) string
+	IssueCSRFToken(w http.ResponseWriter, r *http.Request) string
 }
 
+const sessionCookieName = "persona-session"
+
 type Persona struct {
 	hostname string
 	store    *sessions.CookieStore
+
+	idleTimeout time.Duration
+	maxAge      time.Duration
 }
 
-func NewPersonaHandler(hostname, cookie string) PersonaHandler {
-	store := sessions.NewCookieStore([]byte(cookie))
-	return Persona{hostname, store}
+// NewPersonaHandler signs cookies with the sessionCookie key, and still
+// accepts cookies signed with sessionCookieOldKeys while they are rotated
+// out.
+func NewPersonaHandler(config ServerConfig) PersonaHandler {
+	keyPairs := [][]byte{[]byte(config.SessionCookie), nil}
+	for _, key := range config.SessionCookieOldKeys {
+		keyPairs = append(keyPairs, []byte(key), nil)
+	}
+
+	maxAge := time.Duration(config.SessionMaxAgeHours) * time.Hour
+
+	store := sessions.NewCookieStore(keyPairs...)
+	store.MaxAge(int(maxAge.Seconds()))
+	store.Options.Secure = config.SessionCookieOptions.Secure
+	store.Options.HttpOnly = config.SessionCookieOptions.HttpOnly
+	store.Options.SameSite = config.SessionCookieOptions.sameSiteMode()
+
+	idle := time.Duration(config.SessionIdleHours) * time.Hour
+	return Persona{config.PersonaName, store, idle, maxAge}
+}
+
+// currentSession returns the unexpired session the request's cookie
+// refers to, if any. Expired sessions are deleted on the way.
+func (self Persona) currentSession(r *http.Request) *Session {
+	cookie, _ := self.store.Get(r, sessionCookieName)
+	token, _ := cookie.Values["session"].(string)
+	if token == "" || gDB == nil {
+		return nil
+	}
+
+	session, err := gDB.GetSessionByToken(token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up session", "error", err)
+		return nil
+	}
+
+	if session != nil && sessionExpired(session, time.Now(), self.idleTimeout, self.maxAge) {
+		gDB.DeleteSession(session.User, session.Id)
+		return nil
+	}
+
+	return session
 }
 
 func (self Persona) IsLoggedIn(r *http.Request) bool {
-	session, _ := self.store.Get(r, "persona-session")
-	email := session.Values["email"]
-	return email != nil
+	session := self.currentSession(r)
+	if session == nil {
+		return false
+	}
+
+	now := time.Now()
+	if now.Sub(time.Unix(session.LastSeen, 0)) >= sessionTouchInterval {
+		if err := gDB.TouchSession(session.Id, now); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to update session", "error", err)
+		}
+	}
+
+	return true
 }
 
 func (self Persona) GetLoginName(r *http.Request) string {
-	session, _ := self.store.Get(r, "persona-session")
-	email := session.Values["email"]
-
-	if str, ok := email.(string); ok {
-		return str
+	if session := self.currentSession(r); session != nil {
+		return session.User
 	}
 	return ""
 }
 
+func (self Persona) GetSessionId(r *http.Request) int64 {
+	if session := self.currentSession(r); session != nil {
+		return session.Id
+	}
+	return 0
+}
+
+// endSession deletes the session the cookie refers to, if any.
+func (self Persona) endSession(cookie *sessions.Session) {
+	token, _ := cookie.Values["session"].(string)
+	if token == "" || gDB == nil {
+		return
+	}
+
+	if session, err := gDB.GetSessionByToken(token); err == nil && session != nil {
+		gDB.DeleteSession(session.User, session.Id)
+	}
+}
+
 func (self Persona) Logout(w http.ResponseWriter, r *http.Request) {
-	session, _ := self.store.Get(r, "persona-session")
-	session.Values["email"] = nil
+	cookie, _ := self.store.Get(r, sessionCookieName)
+	self.endSession(cookie)
+	delete(cookie.Values, "session")
+	cookie.Values["csrf"] = newCSRFToken()
+	cookie.Save(r, w)
+}
+
+func (self Persona) GetCSRFToken(r *http.Request) string {
+	session, _ := self.store.Get(r, sessionCookieName)
+	token, _ := session.Values["csrf"].(string)
+	return token
+}
+
+func (self Persona) IssueCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	session, _ := self.store.Get(r, sessionCookieName)
+	if token, ok := session.Values["csrf"].(string); ok && token != "" {
+		return token
+	}
+
+	token := newCSRFToken()
+	session.Values["csrf"] = token
 	session.Save(r, w)
+	return token
 }
 
 func (self Persona) Login(verifierURL string, w http.ResponseWriter, r *http.Request) error {
@@ -84,13 +184,27 @@ func (self Persona) Login(verifierURL string, w http.ResponseWriter, r *http.Req
 	}
 
 	if pr.Status != "okay" {
-		log.Println("Persona failed to verify: " + pr.Reason)
+		slog.WarnContext(r.Context(), "Persona failed to verify", "reason", pr.Reason)
 		return fmt.Errorf("Persona failed to verify")
 	}
 
-	session, _ := self.store.Get(r, "persona-session")
-	session.Values["email"] = pr.Email
-	session.Save(r, w)
+	// A new session and CSRF token, so that neither can be planted
+	// before logging in
+	cookie, _ := self.store.Get(r, sessionCookieName)
+	self.endSession(cookie)
+
+	token := newSessionToken()
+	if _, err = gDB.CreateSession(pr.Email, token, r.UserAgent(), sourceIP(r), time.Now()); err != nil {
+		return fmt.Errorf("Failed to create session")
+	}
+
+	cookie.Values["session"] = token
+	cookie.Values["csrf"] = newCSRFToken()
+	if err = cookie.Save(r, w); err != nil {
+		return fmt.Errorf("Failed to save session")
+	}
+
+	slog.InfoContext(r.Context(), "login", "actor", pr.Email, "outcome", "ok")
 
 	return nil
 }
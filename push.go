@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The only push transport so far is SimplePush.
+const pushTransport = "simplepush"
+
+// Push servers that don't answer shouldn't hold requests, or shutdown,
+// forever.
+const pushTimeout = 30 * time.Second
+
+// Invocations a device didn't fetch by then, e.g. because it was lost or
+// reset, are deleted along with their arguments.
+const invocationLifetime = 7 * 24 * time.Hour
+
+var gPushClient = &http.Client{Timeout: pushTimeout}
+
+// Pushes in flight, waited for on shutdown. Once shutdown started, new
+// pushes are refused and gPushesDone is closed when the last one ends.
+var gPushesLock sync.Mutex
+var gPushes int
+var gPushesClosing bool
+var gPushesDone = make(chan struct{})
+
+var errPushesClosed = errors.New("Server is shutting down")
+
+func startPush() error {
+	gPushesLock.Lock()
+	defer gPushesLock.Unlock()
+
+	if gPushesClosing {
+		return errPushesClosed
+	}
+	gPushes++
+	return nil
+}
+
+func endPush() {
+	gPushesLock.Lock()
+	defer gPushesLock.Unlock()
+
+	gPushes--
+	if gPushesClosing && gPushes == 0 {
+		close(gPushesDone)
+	}
+}
+
+// An invocation pushed to a device, whose context the device didn't fetch
+// yet. Invocations are kept in the database so that they survive restarts,
+// and can be inspected with the admin commands.
+type Invocation struct {
+	Token    int64
+	DeviceId int64
+	Created  int64
+	CommandContext
+}
+
+// AddInvocation stores the context of an invocation. Tokens are the time
+// of the push in seconds, so a later push in the same second replaces the
+// earlier one.
+func (self DB) AddInvocation(token, deviceId int64, invocation CommandContext, now time.Time) error {
+	arguments, err := json.Marshal(invocation.Arguments)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.connection.Exec(
+		`insert or replace into invocations
+		(token, device_id, command_id, arguments, created)
+		values (?, ?, ?, ?, ?)`,
+		token, deviceId, invocation.CommandId, string(arguments), now.Unix())
+
+	return err
+}
+
+func (self DB) scanInvocation(row scanner) (*Invocation, error) {
+	i := Invocation{}
+	var arguments string
+	if err := row.Scan(&i.Token, &i.DeviceId, &i.CommandId, &arguments, &i.Created); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(arguments), &i.Arguments); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+const invocationColumns = `token, device_id, command_id, arguments, created`
+
+// TakeInvocation returns the invocation for the token, or nil if there is
+// none, and forgets it: it can only be retrieved once.
+func (self DB) TakeInvocation(token, deviceId int64) (*Invocation, error) {
+	tx, err := self.connection.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	invocation, err := self.scanInvocation(tx.QueryRow(
+		`select `+invocationColumns+` from invocations where token=?
+		and (?=0 or device_id=?)`, token, deviceId, deviceId))
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(`delete from invocations where token=?`, token); err != nil {
+		return nil, err
+	}
+
+	return invocation, tx.Commit()
+}
+
+func (self DB) ListInvocations() ([]Invocation, error) {
+	res, err := self.connection.Query(
+		`select ` + invocationColumns + ` from invocations order by token`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	invocations := []Invocation{}
+	for res.Next() {
+		i, err := self.scanInvocation(res)
+		if err != nil {
+			return nil, err
+		}
+		invocations = append(invocations, *i)
+	}
+
+	return invocations, res.Err()
+}
+
+func (self DB) PruneInvocations(before int64) (int64, error) {
+	res, err := self.connection.Exec(`delete from invocations where created<?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func pruneInvocations(db *DB, now time.Time) error {
+	_, err := db.PruneInvocations(now.Add(-invocationLifetime).Unix())
+	return err
+}
+
+func (self DB) CountInvocations() (int, error) {
+	var count int
+	err := self.connection.QueryRow(`select count(*) from invocations`).Scan(&count)
+	return count, err
+}
+
+// pushCommand stores the invocation context and notifies the device,
+// which will then fetch the context through its invocation token. ctx is
+// only used for logging, a push isn't cancelled with the request.
+func pushCommand(ctx context.Context, device *Device, invocation CommandContext) (err error) {
+	if err = startPush(); err != nil {
+		return err
+	}
+	defer endPush()
+
+	start := time.Now()
+	token := start.Unix()
+	defer func() {
+		outcome := "delivered"
+		if err != nil {
+			outcome = "failed"
+		}
+
+		slog.InfoContext(ctx, "push",
+			"device_id", device.Id,
+			"transport", pushTransport,
+			"command_id", invocation.CommandId,
+			"token", token,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"outcome", outcome,
+			"error", err)
+	}()
+
+	if err = gDB.AddInvocation(token, device.Id, invocation, start); err != nil {
+		return err
+	}
+
+	// Issue push notification to device
+	body := fmt.Sprintf("version=%d", token)
+	pushRequest, err := http.NewRequest("PUT", device.Endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	pushRequest.Header["Content-Type"] = []string{"application/x-www-form-urlencoded"}
+
+	gPushCount.WithLabelValues(pushTransport).Inc()
+	pushResponse, err := gPushClient.Do(pushRequest)
+	if err != nil {
+		gPushFailures.WithLabelValues(pushTransport).Inc()
+		return err
+	}
+
+	pushResponse.Body.Close()
+	if pushResponse.StatusCode >= 400 {
+		gPushFailures.WithLabelValues(pushTransport).Inc()
+		return fmt.Errorf("Push server responded %s", pushResponse.Status)
+	}
+
+	return nil
+}
+
+// waitForPushes refuses new pushes, and blocks until every push in
+// flight is done, or until ctx expires.
+func waitForPushes(ctx context.Context) error {
+	gPushesLock.Lock()
+	gPushesClosing = true
+	idle, done := gPushes == 0, gPushesDone
+	gPushesLock.Unlock()
+
+	if idle {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
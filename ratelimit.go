@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Classes of routes sharing a rate limit. Commands fan out to the push
+// server, and location reports write to the database, so both get
+// tighter limits than the rest of the API. Pairing codes are short, so
+// guessing them is kept slow.
+const (
+	rateLimitAPI      = "api"
+	rateLimitCommand  = "command"
+	rateLimitLocation = "location"
+	rateLimitPairing  = "pairing"
+)
+
+var rateLimitClasses = []string{rateLimitAPI, rateLimitCommand, rateLimitLocation, rateLimitPairing}
+
+// Buckets are swept once there are this many, at least.
+const rateLimitSweepSize = 1024
+
+// A token bucket holding up to Burst requests, refilled with PerMinute
+// requests every minute. A PerMinute of zero disables the limit.
+type RateLimit struct {
+	PerMinute float64 `json:"perMinute"`
+	Burst     int     `json:"burst"`
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a bucket per key, e.g. per user, device and IP.
+type rateLimiter struct {
+	limit RateLimit
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep int
+}
+
+// Limiters by route class, requests aren't limited when nil.
+var gRateLimiters map[string]*rateLimiter
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		buckets:   map[string]*tokenBucket{},
+		nextSweep: rateLimitSweepSize,
+	}
+}
+
+func newRateLimiters(limits map[string]RateLimit) map[string]*rateLimiter {
+	limiters := map[string]*rateLimiter{}
+	for class, limit := range limits {
+		if limit.PerMinute > 0 {
+			limiters[class] = newRateLimiter(limit)
+		}
+	}
+	return limiters
+}
+
+func (self RateLimit) validate(class string) error {
+	if self.PerMinute < 0 {
+		return fmt.Errorf("rateLimits for %s can't have a negative perMinute", class)
+	}
+
+	if self.PerMinute > 0 && self.Burst < 1 {
+		return fmt.Errorf("rateLimits for %s needs a burst of at least 1", class)
+	}
+
+	return nil
+}
+
+// bucket returns the bucket for key, refilled up to now. Must be called
+// with the lock held.
+func (self *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	bucket, exists := self.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{float64(self.limit.Burst), now}
+		self.buckets[key] = bucket
+		return bucket
+	}
+
+	elapsed := now.Sub(bucket.updated).Minutes()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(float64(self.limit.Burst), bucket.tokens+elapsed*self.limit.PerMinute)
+		bucket.updated = now
+	}
+
+	return bucket
+}
+
+// sweep forgets buckets which are full again, as they are no different
+// from new ones. Must be called with the lock held.
+func (self *rateLimiter) sweep(now time.Time) {
+	for key := range self.buckets {
+		if self.bucket(key, now).tokens >= float64(self.limit.Burst) {
+			delete(self.buckets, key)
+		}
+	}
+
+	self.nextSweep = 2 * len(self.buckets)
+	if self.nextSweep < rateLimitSweepSize {
+		self.nextSweep = rateLimitSweepSize
+	}
+}
+
+// take takes a token from the bucket of every key, only if none of them
+// is empty. Otherwise it returns how long to wait until all of them have
+// a token again.
+func (self *rateLimiter) take(keys []string, now time.Time) (bool, time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.buckets) >= self.nextSweep {
+		self.sweep(now)
+	}
+
+	wait := 0.0
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = self.bucket(key, now)
+		if missing := 1 - buckets[i].tokens; missing > 0 {
+			wait = math.Max(wait, missing/self.limit.PerMinute)
+		}
+	}
+
+	if wait > 0 {
+		return false, time.Duration(wait * float64(time.Minute))
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+
+	return true, 0
+}
+
+// rateLimitKeys are the login name, the device and the IP address of the
+// request, each of which has its own bucket. The device's bucket is only
+// charged for its owner, so that requests for other users' devices,
+// which are refused anyway, can't exhaust it.
+func rateLimitKeys(request *restful.Request) []string {
+	keys := []string{"ip:" + sourceIP(request.Request)}
+
+	// Requests to public routes have no user
+	user := requestUser(request)
+	if user == "" {
+		return keys
+	}
+	keys = append(keys, "user:"+user)
+
+	id, err := strconv.ParseInt(request.PathParameter("device-id"), 10, 64)
+	if err != nil {
+		return keys
+	}
+
+	if device, _ := gDB.GetDeviceById(id); device != nil && device.User == user {
+		keys = append(keys, "device:"+strconv.FormatInt(id, 10))
+	}
+
+	return keys
+}
+
+// rateLimited rejects requests beyond the limit of the class with a 429,
+// telling the client when to retry. Must come after ensureIsLoggedIn.
+func rateLimited(class string) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		limiter := gRateLimiters[class]
+		if limiter == nil {
+			chain.ProcessFilter(request, response)
+			return
+		}
+
+		allowed, wait := limiter.take(rateLimitKeys(request), time.Now())
+		if !allowed {
+			gRateLimited.WithLabelValues(class).Inc()
+			slog.WarnContext(request.Request.Context(), "rate limited",
+				"class", class,
+				"actor", requestUser(request),
+				"source_ip", sourceIP(request.Request))
+
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			response.AddHeader("Retry-After", strconv.Itoa(retryAfter))
+			writeError(request, response, http.StatusTooManyRequests, ErrRateLimited,
+				fmt.Sprintf("Too many requests, retry in %d seconds", retryAfter))
+			return
+		}
+
+		chain.ProcessFilter(request, response)
+	}
+}
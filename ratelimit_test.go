@@ -0,0 +1,105 @@
+package main
+
+import "net/http"
+import "testing"
+import "time"
+
+func TestTokenBucket(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{PerMinute: 6, Burst: 2})
+	now := time.Now()
+	keys := []string{"user:ggp@mozilla.com", "ip:127.0.0.1"}
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.take(keys, now); !allowed {
+			t.Fatalf("Request %d within the burst was refused", i)
+		}
+	}
+
+	allowed, wait := limiter.take(keys, now)
+	if allowed || wait != 10*time.Second {
+		t.Errorf("Request beyond the burst: %v, retry in %s", allowed, wait)
+	}
+
+	// Other users from the same address share its bucket
+	if allowed, _ := limiter.take([]string{"user:other", "ip:127.0.0.1"}, now); allowed {
+		t.Error("Request from a limited address was allowed")
+	}
+
+	// A refused request doesn't take from the other buckets
+	if allowed, _ := limiter.take([]string{"user:other"}, now); !allowed {
+		t.Error("Refused request took a token from another bucket")
+	}
+
+	if allowed, _ := limiter.take(keys, now.Add(10*time.Second)); !allowed {
+		t.Error("Bucket wasn't refilled")
+	}
+
+	limiter.sweep(now.Add(time.Hour))
+	if len(limiter.buckets) != 0 {
+		t.Errorf("Full buckets weren't swept: %d left", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitedLocations(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	gRateLimiters = newRateLimiters(map[string]RateLimit{
+		rateLimitLocation: {PerMinute: 1, Burst: 1},
+	})
+	defer func() { gRateLimiters = nil }()
+
+	if response := doFormRequest("/api/v1/device/location/1", "latitude=1&longitude=2"); response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	response := doFormRequest("/api/v1/device/location/1", "latitude=1&longitude=2")
+	if response.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Unexpected Retry-After: %q", retryAfter)
+	}
+
+	// The unversioned routes share the limit
+	if response := doFormRequest("/device/location/1", "latitude=1&longitude=2"); response.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	// Other classes aren't affected
+	if response := doWebServiceRequest("GET", "/api/v1/device/1", ""); response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
+
+func TestRateLimitedOtherUsersDevice(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	limiter := newRateLimiter(RateLimit{PerMinute: 1, Burst: 1})
+	gRateLimiters = map[string]*rateLimiter{rateLimitLocation: limiter}
+	defer func() { gRateLimiters = nil }()
+
+	charged := func(device string) bool {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		_, exists := limiter.buckets["device:"+device]
+		return exists
+	}
+
+	// Device 3 belongs to another user, whose budget is left alone
+	for i := 0; i < 3; i++ {
+		doFormRequest("/api/v1/device/location/3", "latitude=1&longitude=2")
+	}
+
+	if charged("3") {
+		t.Error("Requests for another user's device were charged to it")
+	}
+
+	limiter.buckets = map[string]*tokenBucket{}
+	doFormRequest("/api/v1/device/location/1", "latitude=1&longitude=2")
+	if !charged("1") {
+		t.Error("Requests for the user's own device weren't charged to it")
+	}
+}
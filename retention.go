@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	pruneInterval           = time.Hour
+	locationDownsampleEvery = int64(time.Hour / time.Second)
+)
+
+func retentionPolicyForUser(user string) RetentionPolicy {
+	if policy, exists := gServerConfig.LocationRetentionOverrides[user]; exists {
+		return policy
+	}
+	return gServerConfig.LocationRetention
+}
+
+func (self DB) ListUsers() ([]string, error) {
+	res, err := self.connection.Query(
+		`select distinct user from devices order by user`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	users := []string{}
+	for res.Next() {
+		var user string
+		if err = res.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, res.Err()
+}
+
+// PruneLocations deletes the user's fixes taken before the given time,
+// and forgets the current location of devices last seen before then, and
+// the addresses looked up before then.
+func (self DB) PruneLocations(user string, before int64) (int64, error) {
+	res, err := self.connection.Exec(
+		`delete from locations where timestamp<? and device_id in
+		(select id from devices where user=?)`, before, user)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = self.connection.Exec(
+		`update devices set latitude=0, longitude=0, timestamp="",
+		accuracy=null, altitude=null, speed=null, heading=null,
+		provider="", battery=null, address=""
+		where user=? and timestamp!="" and cast(timestamp as integer)<?`,
+		user, before)
+
+	if err == nil {
+		err = self.DeleteCachedAddresses(user, before)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DownsampleLocations keeps only the earliest of each device's fixes in
+// each interval for fixes taken before the given time, whatever order
+// they were received in.
+func (self DB) DownsampleLocations(user string, before, interval int64) (int64, error) {
+	res, err := self.connection.Exec(
+		`delete from locations where timestamp<? and device_id in
+		(select id from devices where user=?)
+		and timestamp > (select min(earliest.timestamp) from locations earliest
+		where earliest.device_id=locations.device_id
+		and earliest.timestamp/?=locations.timestamp/?)`, before, user, interval, interval)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteLocationsForUser removes the whole location history of the user's
+// devices, along with their current location and the addresses looked up
+// for them.
+func (self DB) DeleteLocationsForUser(user string) error {
+	_, err := self.connection.Exec(
+		`delete from locations where device_id in
+		(select id from devices where user=?)`, user)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = self.connection.Exec(
+		`update devices set latitude=0, longitude=0, timestamp="",
+		accuracy=null, altitude=null, speed=null, heading=null,
+		provider="", battery=null, address="" where user=?`, user)
+
+	if err != nil {
+		return err
+	}
+
+	return self.DeleteCachedAddresses(user, 0)
+}
+
+func pruneLocations(db *DB, now time.Time) error {
+	users, err := db.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	day := 24 * time.Hour
+	for _, user := range users {
+		policy := retentionPolicyForUser(user)
+
+		if policy.Days > 0 {
+			before := now.Add(-time.Duration(policy.Days) * day).Unix()
+			if _, err = db.PruneLocations(user, before); err != nil {
+				return err
+			}
+		}
+
+		if policy.DownsampleDays > 0 {
+			before := now.Add(-time.Duration(policy.DownsampleDays) * day).Unix()
+			if _, err = db.DownsampleLocations(user, before, locationDownsampleEvery); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Everything deleted once it's too old, by the pruner.
+var gPruners = []struct {
+	name  string
+	prune func(db *DB, now time.Time) error
+}{
+	{"locations", pruneLocations},
+	{"sessions", pruneSessions},
+	{"exports", pruneExports},
+	{"geocoding cache", pruneGeocodeCache},
+	{"invocations", pruneInvocations},
+}
+
+// startPruner runs gPruners right away and then periodically, until the
+// returned function is called.
+func startPruner(db *DB) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(pruneInterval)
+		defer ticker.Stop()
+
+		for {
+			for _, pruner := range gPruners {
+				if err := pruner.prune(db, time.Now()); err != nil {
+					slog.Error("Failed to prune "+pruner.name, "error", err)
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
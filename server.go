@@ -1,40 +1,54 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/emicklei/go-restful"
 	"go/build"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var gDB *DB
 var gPersona PersonaHandler
-var gPendingCommands map[int64]CommandContext
+
+const shutdownTimeout = 30 * time.Second
+
+// How long /readyz fails before connections are refused, for load
+// balancers to notice.
+const shutdownDrainDelay = 5 * time.Second
 
 type CommandContext struct {
-	CommandId int64           `json: "commandid"`
-	Arguments map[string]bool `json: "arguments"`
+	CommandId int64           `json:"commandId"`
+	Arguments map[string]bool `json:"arguments"`
 }
 
 type CommandResponse struct {
-	Name        string `json: "name"`
-	Description string `json: "description"`
-	Trigger     string `json: "trigger"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Trigger     string `json:"trigger"`
+	Destructive bool   `json:"destructive"`
 }
 
 func serveIndexHtml(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(gServerConfig.PackagePath, "static", "index.html"))
 }
 
+// ensureIsLoggedIn also lets devices through with their token, on the
+// routes meant for them.
 func ensureIsLoggedIn(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
-	if !gPersona.IsLoggedIn(request.Request) {
-		response.WriteErrorString(http.StatusUnauthorized, "Not logged in")
+	if gPersona.IsLoggedIn(request.Request) {
+		gSessionActivity.seen(gPersona.GetLoginName(request.Request), time.Now())
+	} else if !authenticateDevice(request) {
+		writeError(request, response, http.StatusUnauthorized, ErrNotLoggedIn, "Not logged in")
 		return
 	}
 
@@ -44,41 +58,73 @@ func ensureIsLoggedIn(request *restful.Request, response *restful.Response, chai
 func getDeviceForRequest(request *restful.Request, response *restful.Response) *Device {
 	id, err := strconv.ParseInt(request.PathParameter("device-id"), 10, 64)
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse device")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse device")
+		return nil
+	}
+
+	// Devices can only act for themselves
+	if token := tokenDevice(request); token != nil && token.Id != id {
+		writeError(request, response, http.StatusNotFound, ErrDeviceNotFound, "Device not found")
 		return nil
 	}
 
 	device, err := gDB.GetDeviceById(id)
-	if device != nil && device.User == gPersona.GetLoginName(request.Request) {
+	if device != nil && device.User == requestUser(request) {
 		return device
 	}
 
-	response.WriteErrorString(http.StatusNotFound, "Device not found")
+	writeError(request, response, http.StatusNotFound, ErrDeviceNotFound, "Device not found")
 	return nil
 }
 
 func addDevice(request *restful.Request, response *restful.Response) {
 	indevice := new(Device)
-	request.ReadEntity(indevice)
+	if err := request.ReadEntity(indevice); err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse device")
+		return
+	}
 
 	name := indevice.Name
 	endpoint := indevice.Endpoint
 
 	if name == "" || endpoint == "" {
-		response.WriteErrorString(http.StatusBadRequest, "No name or endpoint")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "No name or endpoint")
 		return
 	}
 
 	device, err := gDB.AddDevice(gPersona.GetLoginName(request.Request), name, endpoint)
 	if err == nil {
-		response.WriteEntity(*device)
+		audit(request, device.Id, AuditDeviceAdd, "", map[string]string{"name": name}, "ok")
+		if isVersionedAPI(request) {
+			response.AddHeader("Location", fmt.Sprintf("%s/device/%d", apiRoot(request), device.Id))
+			writeEntity(request, response, http.StatusCreated, *device)
+		} else {
+			writeEntity(request, response, http.StatusOK, *device)
+		}
 	} else {
-		response.WriteErrorString(http.StatusInternalServerError, "Failed to add device")
+		audit(request, 0, AuditDeviceAdd, "", map[string]string{"name": name}, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to add device")
 	}
 }
 
 func serveDevicesByUser(request *restful.Request, response *restful.Response) {
-	devices, _ := gDB.ListDevicesForUser(gPersona.GetLoginName(request.Request))
+	page, err := parsePagination(request)
+	if err != nil && isVersionedAPI(request) {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	devices, err := gDB.ListDevicesForUser(gPersona.GetLoginName(request.Request))
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve devices")
+		return
+	}
+
+	if isVersionedAPI(request) {
+		start, end := page.bounds(len(devices))
+		writeEntity(request, response, http.StatusOK, DevicePage{devices[start:end], page})
+		return
+	}
 
 	urls := []string{}
 	for _, d := range devices {
@@ -90,34 +136,47 @@ func serveDevicesByUser(request *restful.Request, response *restful.Response) {
 
 func serveDevice(request *restful.Request, response *restful.Response) {
 	if device := getDeviceForRequest(request, response); device != nil {
-		response.WriteEntity(*device)
+		writeEntity(request, response, http.StatusOK, *device)
 	}
 }
 
-func toCommandResponse(device *Device, command *Command) CommandResponse {
-	trigger := fmt.Sprintf("/device/%d/command/%d", device.Id, command.Id)
-	return CommandResponse{command.Name, command.Description, trigger}
+// Triggers point to the same version of the API as the request.
+func toCommandResponse(root string, device *Device, command *Command) CommandResponse {
+	trigger := fmt.Sprintf("%s/device/%d/command/%d", root, device.Id, command.Id)
+	return CommandResponse{command.Name, command.Description, trigger, command.Destructive}
 }
 
 func serveCommandsByDevice(request *restful.Request, response *restful.Response) {
 	device := getDeviceForRequest(request, response)
 	if device == nil {
-		response.WriteErrorString(http.StatusBadRequest, "No device in request")
+		return
+	}
+
+	page, err := parsePagination(request)
+	if err != nil && isVersionedAPI(request) {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, err.Error())
 		return
 	}
 
 	commands, err := gDB.ListCommandsForDevice(device)
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to retrieve commands")
+		writeError(request, response, legacyStatus(request, http.StatusInternalServerError, http.StatusBadRequest),
+			ErrInternal, "Failed to retrieve commands")
 		return
 	}
 
 	responses := make([]CommandResponse, len(commands))
 	for i, cmd := range commands {
-		responses[i] = toCommandResponse(device, cmd)
+		responses[i] = toCommandResponse(apiRoot(request), device, cmd)
 	}
 
-	response.WriteEntity(responses)
+	if isVersionedAPI(request) {
+		start, end := page.bounds(len(responses))
+		writeEntity(request, response, http.StatusOK, CommandPage{responses[start:end], page})
+		return
+	}
+
+	writeEntity(request, response, http.StatusOK, responses)
 }
 
 func updateCommandsByDevice(request *restful.Request, response *restful.Response) {
@@ -128,14 +187,17 @@ func updateCommandsByDevice(request *restful.Request, response *restful.Response
 
 	commands := []int64{}
 	if err := request.ReadEntity(&commands); err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse commands")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse commands")
 		return
 	}
 
 	if err := gDB.UpdateCommandsForDevice(device.Id, commands); err != nil {
-		response.WriteErrorString(http.StatusInternalServerError, "Failed to update commands")
+		audit(request, device.Id, AuditDeviceCommands, "", commands, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to update commands")
 		return
 	}
+
+	audit(request, device.Id, AuditDeviceCommands, "", commands, "ok")
 }
 
 func updateDeviceLocation(request *restful.Request, response *restful.Response) {
@@ -144,38 +206,94 @@ func updateDeviceLocation(request *restful.Request, response *restful.Response)
 		return
 	}
 
-	latitude, err := strconv.ParseFloat(request.QueryParameter("latitude"), 64)
+	location, err := parseLocationForm(request.Request)
+	if err == nil {
+		err = location.Validate()
+	}
+
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse latitude")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidLocation, err.Error())
+		return
 	}
 
-	longitude, err := strconv.ParseFloat(request.QueryParameter("longitude"), 64)
+	gLocationReports.WithLabelValues("single").Inc()
+
+	err = gDB.UpdateDeviceLocation(device, location)
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse longitude")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to update location")
+		return
 	}
 
-	err = gDB.UpdateDeviceLocation(device, latitude, longitude)
+	queueGeocoding(device, []Location{location})
+}
+
+func updateDeviceLocations(request *restful.Request, response *restful.Response) {
+	device := getDeviceForRequest(request, response)
+	if device == nil {
+		return
+	}
+
+	locations := []Location{}
+	if err := request.ReadEntity(&locations); err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse locations")
+		return
+	}
+
+	sorted, err := sortLocationBatch(locations)
+	if batchErr, ok := err.(LocationBatchError); ok {
+		writeErrorDetails(request, response, http.StatusBadRequest, ErrInvalidLocation, err.Error(),
+			map[string]interface{}{"index": batchErr.Index, "reason": batchErr.Err.Error()})
+		return
+	} else if err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidLocation, err.Error())
+		return
+	}
+
+	gLocationReports.WithLabelValues("batch").Inc()
+
+	stored, err := gDB.AddDeviceLocations(device, sorted)
 	if err != nil {
-		response.WriteErrorString(http.StatusInternalServerError, "Failed to update location")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to store locations")
+		return
 	}
+
+	queueGeocoding(device, sorted)
+
+	response.WriteEntity(LocationBatchResponse{len(locations), stored})
 }
 
 func serveInvocation(request *restful.Request, response *restful.Response) {
 	token, err := strconv.ParseInt(request.PathParameter("token"), 10, 64)
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse invocation")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse invocation")
 		return
 	}
 
-	// TODO check whether invocation was actually intended for device? how?
-	context, exists := gPendingCommands[token]
-	if !exists {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to find invocation")
+	// Devices with a token only get their own invocations
+	deviceId := int64(0)
+	if device := tokenDevice(request); device != nil {
+		deviceId = device.Id
+	}
+
+	invocation, err := gDB.TakeInvocation(token, deviceId)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve invocation")
 		return
 	}
 
-	delete(gPendingCommands, token)
-	response.WriteEntity(context)
+	if invocation == nil {
+		slog.WarnContext(request.Request.Context(), AuditCommand, "token", token, "outcome", "unknown invocation")
+		writeError(request, response, legacyStatus(request, http.StatusNotFound, http.StatusBadRequest),
+			ErrInvocationNotFound, "Failed to find invocation")
+		return
+	}
+
+	slog.InfoContext(request.Request.Context(), AuditCommand,
+		"command_id", invocation.CommandId,
+		"token", token,
+		"outcome", "fetched")
+
+	writeEntity(request, response, http.StatusOK, invocation.CommandContext)
 }
 
 func triggerCommand(request *restful.Request, response *restful.Response) {
@@ -186,131 +304,199 @@ func triggerCommand(request *restful.Request, response *restful.Response) {
 
 	cmdid, err := strconv.ParseInt(request.PathParameter("command-id"), 10, 64)
 	if err != nil {
-		response.WriteErrorString(http.StatusBadRequest, "Failed to parse command")
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse command")
 		return
 	}
 
 	// Check whether the device actually implements the command
-	implements := false
+	var command *Command
 
 	commands, _ := gDB.ListCommandsForDevice(device)
 	for _, cmd := range commands {
 		if cmd.Id == cmdid {
-			implements = true
+			command = cmd
 			break
 		}
 	}
 
-	if implements == false {
-		response.WriteErrorString(http.StatusBadRequest, "No such command for device")
+	if command == nil {
+		audit(request, device.Id, AuditCommand, strconv.FormatInt(cmdid, 10), nil, "no such command")
+		writeError(request, response, legacyStatus(request, http.StatusNotFound, http.StatusBadRequest),
+			ErrCommandNotFound, "No such command for device")
 		return
 	}
 
-	token := int64(time.Now().Unix())
 	context := CommandContext{CommandId: cmdid}
 
 	// Store pending arguments, if any
 	if request.Request.ContentLength != 0 {
 		if err = request.ReadEntity(&context.Arguments); err != nil {
-			response.WriteErrorString(http.StatusBadRequest, "Failed to parse arguments")
+			audit(request, device.Id, AuditCommand, command.Name, nil, "invalid arguments")
+			writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse arguments")
 			return
 		}
 	}
-	gPendingCommands[token] = context
 
-	// Issue push notification to device
-	body := fmt.Sprintf("version=%d", token)
-	pushRequest, err := http.NewRequest("PUT", device.Endpoint, strings.NewReader(body))
-	if err != nil {
-		response.WriteErrorString(http.StatusInternalServerError, "Failed to push command")
+	if command.Destructive {
+		requestConfirmation(request, response, device, command, context)
 		return
 	}
 
-	pushRequest.Header["Content-Type"] = []string{"application/x-www-form-urlencoded"}
-
-	var client http.Client
-	_, err = client.Do(pushRequest)
-	if err != nil {
-		response.WriteErrorString(http.StatusInternalServerError, "Failed to push command")
+	if err = pushCommand(request.Request.Context(), device, context); err != nil {
+		audit(request, device.Id, AuditCommand, command.Name, context.Arguments, "push failed")
+		writeError(request, response, legacyStatus(request, http.StatusBadGateway, http.StatusInternalServerError),
+			ErrPushFailed, "Failed to push command")
+		return
 	}
+
+	audit(request, device.Id, AuditCommand, command.Name, context.Arguments, "pushed")
 }
 
-func createDeviceWebService() *restful.WebService {
+func createDeviceWebService(root string) *restful.WebService {
 	ws := new(restful.WebService)
 
 	ws.
+		Filter(withAPIRoot(root)).
+		Filter(observeRequest).
 		Filter(ensureIsLoggedIn).
-		Path("/device").
+		Filter(checkCSRF).
+		Filter(rateLimited(rateLimitAPI)).
+		Path(root + "/device").
 		Consumes(restful.MIME_JSON).
-		Produces(restful.MIME_JSON)
+		Produces(restful.MIME_JSON, legacyMIME)
 
-	ws.
-		Route(ws.GET("/").To(serveDevicesByUser).
-		Doc("Retrieve all devices owned by a user").
-		Writes([]Device{}))
+	list := ws.GET("/").To(serveDevicesByUser)
+	if root == "" {
+		list.
+			Doc("Retrieve the URLs of all devices owned by a user").
+			Writes([]string{})
+	} else {
+		list.
+			Doc("Retrieve the devices owned by a user").
+			Writes(DevicePage{})
+		for _, param := range pageParameters(ws) {
+			list.Param(param)
+		}
+	}
+
+	ws.Route(list)
 
 	ws.
 		Route(ws.GET("/{device-id}").To(serveDevice).
 		Doc("Retrieve a device based on its id").
-		Param(ws.PathParameter("device-id", "The identifier for the device")).
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
 		Writes(Device{}))
 
 	ws.
 		Route(ws.PUT("/").To(addDevice).
 		Consumes("application/json").
 		Doc("Add a device").
-		Param(ws.QueryParameter("name", "The name for the device")).
-		Param(ws.QueryParameter("endpoint", "The push endpoint for the device")).
+		Notes("Only the name and the push endpoint of the device are read, both are required").
+		Reads(Device{}).
 		Writes(Device{}))
 
 	ws.
 		Route(ws.POST("/location/{device-id}").To(updateDeviceLocation).
 		Consumes("application/x-www-form-urlencoded").
-		Doc("Update a device's latitude and longitude").
-		Param(ws.QueryParameter("latitude", "The latitude where the device was observed")).
-		Param(ws.QueryParameter("longitude", "The longitude where the device was observed")))
+		Filter(rateLimited(rateLimitLocation)).
+		Metadata(routeAuthMetadata, authDeviceToken).
+		Doc("Report a device's location").
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Param(ws.FormParameter("latitude", "The latitude where the device was observed").DataType("number").Required(true)).
+		Param(ws.FormParameter("longitude", "The longitude where the device was observed").DataType("number").Required(true)).
+		Param(ws.FormParameter("accuracy", "Radius of uncertainty of the fix, in meters").DataType("number")).
+		Param(ws.FormParameter("altitude", "Altitude above sea level, in meters").DataType("number")).
+		Param(ws.FormParameter("speed", "Ground speed, in meters per second").DataType("number")).
+		Param(ws.FormParameter("heading", "Direction of travel, in degrees clockwise from true north").DataType("number")).
+		Param(ws.FormParameter("provider", "Source of the fix: gps, wifi, cell or network")).
+		Param(ws.FormParameter("battery", "Battery level of the device, in percent").DataType("number")).
+		Param(ws.FormParameter("timestamp", "Time of the fix on the device, in seconds since the epoch").DataType("integer")))
+
+	ws.
+		Route(ws.POST("/{device-id}/locations").To(updateDeviceLocations).
+		Consumes("application/json").
+		Filter(rateLimited(rateLimitLocation)).
+		Metadata(routeAuthMetadata, authDeviceToken).
+		Doc("Upload a batch of timestamped fixes buffered by a device").
+		Notes("Fixes are stored in time order, duplicates are ignored, and the newest one becomes the device's location").
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Reads([]Location{}).
+		Writes(LocationBatchResponse{}))
 
 	ws.
-		Route(ws.GET("/{device-id}/command").To(serveCommandsByDevice).
+		Route(ws.GET(`/{device-id}/{track:track\.(geojson|gpx|kml)}`).To(serveDeviceTrack).
+		Produces("application/geo+json", "application/gpx+xml", "application/vnd.google-earth.kml+xml").
+		Doc("Export a device's location history as GeoJSON, GPX or KML").
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Param(ws.PathParameter("track", "One of track.geojson, track.gpx or track.kml")).
+		Param(ws.QueryParameter("from", "Only fixes at or after this time, in seconds since the epoch or RFC 3339")).
+		Param(ws.QueryParameter("to", "Only fixes at or before this time, in seconds since the epoch or RFC 3339")))
+
+	commands := ws.GET("/{device-id}/command").To(serveCommandsByDevice).
+		Metadata(routeAuthMetadata, authDeviceToken).
 		Doc("List the commands available for a device").
-		Param(ws.PathParameter("device-id", "The identifier for the device")).
-		Writes([]CommandResponse{}))
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer"))
+
+	if root == "" {
+		commands.Writes([]CommandResponse{})
+	} else {
+		commands.Writes(CommandPage{})
+		for _, param := range pageParameters(ws) {
+			commands.Param(param)
+		}
+	}
+
+	ws.Route(commands)
 
 	ws.
 		Route(ws.PUT("/{device-id}/command").To(updateCommandsByDevice).
 		Consumes("application/json").
+		Metadata(routeAuthMetadata, authDeviceToken).
 		Doc("Update the list of commands available for a device").
-		Param(ws.PathParameter("device-id", "The identifier for the device")).
-		Param(ws.QueryParameter("commands", "List of command ids supported by the device")))
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Reads([]int64{}, "List of command ids supported by the device"))
 
 	ws.
 		Route(ws.POST("/{device-id}/command/{command-id}").To(triggerCommand).
 		Consumes("application/json").
+		Filter(rateLimited(rateLimitCommand)).
 		Doc("Trigger a command").
-		Param(ws.PathParameter("device-id", "The identifier for the device")).
-		Param(ws.PathParameter("command-id", "The identifier for the command")).
-		Param(ws.QueryParameter("parameters", "An object with values for parameters")))
+		Notes("Destructive commands are only pushed once confirmed").
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Param(ws.PathParameter("command-id", "The identifier for the command").DataType("integer")).
+		Reads(map[string]bool{}, "An object with values for parameters").
+		Returns(http.StatusOK, "The command was pushed to the device", nil).
+		Returns(http.StatusAccepted, "The command must be confirmed", ConfirmationResponse{}))
+
+	ws.
+		Route(ws.POST("/{device-id}/confirm/{confirmation-id}").To(confirmCommand).
+		Consumes("application/json").
+		Filter(rateLimited(rateLimitCommand)).
+		Doc("Confirm a destructive command, pushing it to the device").
+		Param(ws.PathParameter("device-id", "The identifier for the device").DataType("integer")).
+		Param(ws.PathParameter("confirmation-id", "The identifier returned when triggering the command")).
+		Reads(ConfirmationRequest{}))
 
 	// FIXME should this be under /device?
 	ws.
 		Route(ws.GET("/invocation/{token}").To(serveInvocation).
+		Metadata(routeAuthMetadata, authDeviceToken).
 		Doc("Get the invocation context of a command").
-		Param(ws.PathParameter("token", "The invocation identifier")).
+		Param(ws.PathParameter("token", "The invocation identifier").DataType("integer")).
 		Writes(CommandContext{}))
 
 	return ws
 }
 
 func setupPersonaHandlers() {
-	gPersona = NewPersonaHandler(gServerConfig.PersonaName, gServerConfig.SessionCookie)
-	http.HandleFunc("/auth/login", makePersonaLoginHandler("https://verifier.login.persona.org/verify"))
-	http.HandleFunc("/auth/applogin", makePersonaLoginHandler("https://firefoxos.persona.org/verify"))
-	http.HandleFunc("/auth/logout", gPersona.Logout)
+	gPersona = NewPersonaHandler(gServerConfig)
+	http.HandleFunc("/auth/csrf", serveCSRFToken)
+	http.HandleFunc("/auth/login", withCSRFCheck(makePersonaLoginHandler("https://verifier.login.persona.org/verify")))
+	http.HandleFunc("/auth/applogin", withCSRFCheck(makePersonaLoginHandler("https://firefoxos.persona.org/verify")))
+	http.HandleFunc("/auth/logout", withCSRFCheck(logout))
 
 	http.HandleFunc("/manifest.webapp", func(w http.ResponseWriter, r *http.Request) {
 		filename := "./app/manifest.webapp"
-		log.Println("serving manifest from " + filename)
-
 		w.Header()["Content-Type"] = []string{"application/x-web-app-manifest+json"}
 		http.ServeFile(w, r, filename)
 	})
@@ -319,13 +505,11 @@ func setupPersonaHandlers() {
 func setupStaticHandlers(packagePath string) {
 	http.HandleFunc("/", serveIndexHtml)
 	http.HandleFunc("/index.html", serveIndexHtml)
-	log.Println(path.Join(packagePath, "static"))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(path.Join(packagePath, "static")))))
 }
 
 func defaultBase(path string) string {
 	p, err := build.Default.Import(path, "", build.FindOnly)
-	log.Println(p)
 	if err != nil {
 		return "."
 	}
@@ -337,51 +521,222 @@ func makePersonaLoginHandler(verifierURL string) func(http.ResponseWriter, *http
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := gPersona.Login(verifierURL, w, r)
 		if err != nil {
+			slog.WarnContext(r.Context(), "login", "outcome", "failed", "error", err)
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte(err.Error()))
 		} else {
-			w.WriteHeader(http.StatusOK)
+			writeCSRFToken(w, gPersona.GetCSRFToken(r))
 		}
 	}
 }
 
+func logout(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "logout", "actor", gPersona.GetLoginName(r))
+	gPersona.Logout(w, r)
+}
+
 func main() {
 	var packagePath = defaultBase("github.com/dougt/whereismyfox")
 	var configFile = flag.String("config", path.Join(packagePath, "config.json"), "Location of configuration file")
 	var dbFile = flag.String("db", path.Join(packagePath, "db.sqlite"), "Location of database")
+	var reencrypt = flag.Bool("reencrypt", false, "Encrypt all coordinates and endpoints with the current key, then exit")
+	var checkConfig = flag.Bool("check-config", false, "Report every problem with the configuration, then exit")
+	configOverrides := registerConfigFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		printAdminUsage(flag.CommandLine.Output())
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	readConfig(*configFile)
+	args := flag.Args()
+	serve := len(args) == 0 || len(args) == 1 && args[0] == "serve"
+	if command, _ := findAdminCommand(args); !serve && command == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The configuration file is optional, unless one was explicitly given
+	configExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		configExplicit = configExplicit || f.Name == "config"
+	})
+
+	if _, err := os.Stat(*configFile); err != nil && !configExplicit {
+		*configFile = ""
+	}
+
+	config, err := loadConfig(*configFile, os.Environ(), configOverrides)
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+
+	gServerConfig = config
 	gServerConfig.PackagePath = packagePath
 
+	// Falls back to the default logger if the configuration is invalid,
+	// which is reported below.
+	setupLogging(gServerConfig)
+
+	problems := gServerConfig.Validate()
+	for _, problem := range problems {
+		slog.Error("Configuration problem", "error", problem)
+	}
+
+	if *checkConfig && len(problems) == 0 {
+		slog.Info("Configuration OK")
+		return
+	}
+
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+
+	cipher, err := loadFieldCipher(gServerConfig)
+	if err != nil {
+		fatal("Failed to load encryption keys", "error", err)
+	}
+
+	// Until exiting, so that the database isn't restored while serving
+	if serve {
+		lock, err := lockDatabase(*dbFile)
+		if err != nil {
+			fatal("Failed to lock database", "error", err)
+		}
+		defer lock.Close()
+	}
+
 	db, err := OpenDB(*dbFile)
 	if err != nil {
-		panic(err)
+		fatal("Failed to open database", "file", *dbFile, "error", err)
+	}
+
+	db.SetCipher(cipher)
+
+	if _, err = db.IndexEndpoints(); err != nil {
+		fatal("Failed to index push endpoints", "error", err)
+	}
+
+	if *reencrypt {
+		updated, err := db.Reencrypt()
+		db.Close()
+		if err != nil {
+			fatal("Failed to re-encrypt database", "error", err)
+		}
+		slog.Info("Re-encrypted database", "rows", updated)
+		return
+	}
+
+	if !serve {
+		err = runAdminCommand(db, os.Stdout, args)
+		db.Close()
+		if err != nil {
+			fatal("Command failed", "command", strings.Join(args, " "), "error", err)
+		}
+		return
 	}
 
 	gDB = db
 	if err = populateCommandsDB(db, path.Join(packagePath, "commands.json")); err != nil {
-		panic(err)
+		fatal("Failed to load commands", "error", err)
 	}
 
-	gPendingCommands = map[int64]CommandContext{}
+	if err = db.FailPendingExports(time.Now()); err != nil {
+		fatal("Failed to clean up exports", "error", err)
+	}
 
-	restful.Add(createDeviceWebService())
+	if gGeocoder, err = loadGeocoder(gServerConfig); err != nil {
+		fatal("Failed to load geocoder", "error", err)
+	}
+
+	gRateLimiters = newRateLimiters(gServerConfig.RateLimits)
+	stopPruner := startPruner(db)
+	stopBackups := startBackupScheduler(db)
+	stopGeocoder := startGeocoder(db)
+
+	registerWebServices()
 	setupPersonaHandlers()
+	setupMetricsHandlers()
+	setupHealthHandlers()
+	setupAdminHandlers()
+	setupAPIDocsHandlers()
 	setupStaticHandlers(packagePath)
 
-	log.Println("Listening on", gServerConfig.Hostname+":"+gServerConfig.Port)
+	servers := []*http.Server{{
+		Addr:    gServerConfig.Hostname + ":" + gServerConfig.Port,
+		Handler: withRequestLogging(http.DefaultServeMux),
+	}}
+	server := servers[0]
 
+	redirectHandler := http.Handler(nil)
 	if gServerConfig.UseTLS {
-		err = http.ListenAndServeTLS(gServerConfig.Hostname+":"+gServerConfig.Port,
-			gServerConfig.CertFilename,
-			gServerConfig.KeyFilename,
-			nil)
-	} else {
-		log.Println("This is a really unsafe way to run the server.  Really.  Don't do this in production.")
-		err = http.ListenAndServe(gServerConfig.Hostname+":"+gServerConfig.Port, nil)
+		server.TLSConfig, redirectHandler, err = tlsConfig(gServerConfig)
+		if err != nil {
+			fatal("Failed to set up TLS", "error", err)
+		}
+	}
+
+	if gServerConfig.RedirectPort != "" {
+		servers = append(servers, &http.Server{
+			Addr:    gServerConfig.Hostname + ":" + gServerConfig.RedirectPort,
+			Handler: withRequestLogging(redirectHandler),
+		})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			slog.Info("Listening", "address", s.Addr, "tls", s.TLSConfig != nil)
+
+			if s.TLSConfig != nil {
+				serverErr <- s.ListenAndServeTLS("", "")
+			} else {
+				if s == server {
+					slog.Warn("Serving plain HTTP, don't do this in production")
+				}
+				serverErr <- s.ListenAndServe()
+			}
+		}(s)
 	}
 
-	log.Println("Exiting... ", err)
+	select {
+	case err = <-serverErr:
+		slog.Error("Exiting", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+		gShuttingDown.Store(true)
+		time.Sleep(shutdownDrainDelay)
+	}
+
+	shutdown(servers...)
+
+	stopPruner()
+	stopBackups()
+	stopGeocoder()
 	gDB.Close()
 }
+
+// shutdown stops accepting connections, then waits for requests and pushes
+// in flight to complete, within shutdownTimeout.
+func shutdown(servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Failed to drain requests", "address", server.Addr, "error", err)
+		}
+	}
+
+	if err := waitForPushes(ctx); err != nil {
+		slog.Error("Failed to complete pushes", "error", err)
+	}
+
+	if err := waitForExports(ctx); err != nil {
+		slog.Error("Failed to complete exports", "error", err)
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import "encoding/json"
+import "encoding/xml"
+import "context"
+import "fmt"
+import "io/ioutil"
+import "log/slog"
 import "net/http"
 import "net/http/httptest"
 import "strings"
 import "testing"
+import "time"
 import "github.com/emicklei/go-restful"
 
 type MockPersona struct {
@@ -31,20 +37,40 @@ func (self MockPersona) Login(verifierURL string, w http.ResponseWriter, r *http
 	panic("Login should not have been called!")
 }
 
+func (self MockPersona) GetSessionId(r *http.Request) int64 {
+	return 0
+}
+
+const testCSRFToken = "test-csrf-token"
+
+func (self MockPersona) GetCSRFToken(r *http.Request) string {
+	return testCSRFToken
+}
+
+func (self MockPersona) IssueCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	return testCSRFToken
+}
+
 var gHandlersInitialized = false
 func initTestingServer(t *testing.T) func() {
 	db, cleanup := initTestDatabase(t)
 
 	gDB = db
 	gServerConfig = ServerConfig{}
-	gPersona = MockPersona{LoggedIn: true}
+	gPairingFailures = map[string]*pairingFailures{}
 
 	if gHandlersInitialized == false {
 		gHandlersInitialized = true
-		restful.Add(createDeviceWebService())
+		registerWebServices()
 		setupPersonaHandlers()
+		setupMetricsHandlers()
+		setupHealthHandlers()
+		setupAPIDocsHandlers()
 	}
 
+	// Set up after the handlers, which install the real one
+	gPersona = MockPersona{LoggedIn: true}
+
 	return func() {
 		cleanup()
 		gDB = nil
@@ -61,11 +87,24 @@ func doNonWebServiceRequest(method, url, body string) *httptest.ResponseRecorder
 	return doRequest(method, url, body, http.DefaultServeMux)
 }
 
+func doFormRequest(url, form string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest("POST", url, strings.NewReader(form))
+	request.Header["Content-Type"] = []string{"application/x-www-form-urlencoded"}
+	request.Header.Set(csrfHeader, testCSRFToken)
+
+	response := httptest.NewRecorder()
+	restful.DefaultContainer.ServeHTTP(response, request)
+	return response
+}
+
 func doRequest(method, url, body string, handler http.Handler) *httptest.ResponseRecorder {
 	request, _ := http.NewRequest(method, url, strings.NewReader(body))
 	if body != "" {
 		request.Header["Content-Type"] = []string{"application/json"}
 	}
+	if !isSafeMethod(method) {
+		request.Header.Set(csrfHeader, testCSRFToken)
+	}
 
 	response := httptest.NewRecorder()
 	handler.ServeHTTP(response, request)
@@ -140,13 +179,13 @@ func TestServeDevice(t *testing.T) {
 	defer cleanup()
 
 	response := doWebServiceRequest("GET", "/device/1", "")
-	result := Device{}
+	result := legacyDevice{}
 
 	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
 		t.Error("Failed to unmarshal response: " + err.Error())
 	}
 
-	expected := gTestDevices[0]
+	expected := legacyDevice(gTestDevices[0])
 	if result != expected {
 		t.Error("Mismatch in device response: %#v != %#v", result, expected)
 	}
@@ -192,3 +231,762 @@ func TestUpdateCommands(t *testing.T) {
 		t.Errorf("Unexpected response code: %d", response.Code)
 	}
 }
+
+func TestServeAuditLog(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	deviceJSON := `{
+		"name": "test-device10",
+		"endpoint": "http://push.mozilla.com/7eb89e37-df89-4829-a437-7748f9d03910"
+	}`
+
+	doWebServiceRequest("PUT", "/device/", deviceJSON)
+	doWebServiceRequest("PUT", "/device/1/command", `[1, 2]`)
+
+	response := doWebServiceRequest("GET", "/audit?action="+AuditDeviceAdd, "")
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	entries := []AuditEntry{}
+	if err := json.Unmarshal(response.Body.Bytes(), &entries); err != nil {
+		t.Error("Failed to unmarshal response: " + err.Error())
+	}
+
+	if len(entries) != 1 || entries[0].Actor != "ggp@mozilla.com" || entries[0].Outcome != "ok" {
+		t.Errorf("Unexpected audit entries: %#v", entries)
+	}
+
+	response = doWebServiceRequest("GET", "/audit?format=csv", "")
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	if len(lines) != 3 {
+		t.Errorf("Unexpected CSV audit log: %s", response.Body.String())
+	}
+}
+
+// Adds a device whose push endpoint is a local server, and returns the
+// device id along with a channel receiving each push notification body.
+func addPushableDevice(t *testing.T) (int64, chan string, func()) {
+	pushes := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes <- string(body)
+	}))
+
+	device, err := gDB.AddDevice("ggp@mozilla.com", "pushable", server.URL)
+	if err != nil {
+		t.Fatal("Failed to add device: " + err.Error())
+	}
+
+	for _, command := range gTestCommands {
+		gDB.AddCommandForDevice(device.Id, command.Id)
+	}
+
+	return device.Id, pushes, server.Close
+}
+
+func TestWaitForPushes(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	go pushCommand(context.Background(), &Device{Endpoint: server.URL}, CommandContext{})
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := waitForPushes(ctx); err == nil {
+		t.Errorf("Returned before the push in flight completed")
+	}
+
+	// Pushes started after shutdown began are refused
+	if err := pushCommand(context.Background(), &Device{Endpoint: server.URL}, CommandContext{}); err != errPushesClosed {
+		t.Errorf("Push was accepted while shutting down: %v", err)
+	}
+
+	close(release)
+	if err := waitForPushes(context.Background()); err != nil {
+		t.Errorf("Failed to wait for pushes: %s", err)
+	}
+
+	gPushesLock.Lock()
+	gPushesClosing = false
+	gPushesDone = make(chan struct{})
+	gPushesLock.Unlock()
+}
+
+func TestTriggerDestructiveCommand(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	deviceId, pushes, closeServer := addPushableDevice(t)
+	defer closeServer()
+
+	trigger := fmt.Sprintf("/device/%d/command/3", deviceId)
+	response := doWebServiceRequest("POST", trigger, "{}")
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	confirmation := ConfirmationResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), &confirmation); err != nil {
+		t.Fatal("Failed to unmarshal response: " + err.Error())
+	}
+
+	if confirmation.TOTPRequired || len(pushes) != 0 {
+		t.Errorf("Destructive command was not held back: %#v", confirmation)
+	}
+
+	// Another device can't be used to confirm
+	response = doWebServiceRequest("POST", "/device/1/confirm/"+confirmation.Id, "{}")
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	response = doWebServiceRequest("POST", confirmation.Confirm, "{}")
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	if len(pushes) != 1 {
+		t.Errorf("Unexpected number of pushes: %d", len(pushes))
+	}
+
+	// Confirmations can only be used once
+	response = doWebServiceRequest("POST", confirmation.Confirm, "{}")
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
+
+func TestConfirmWithTOTP(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	deviceId, pushes, closeServer := addPushableDevice(t)
+	defer closeServer()
+
+	response := doWebServiceRequest("PUT", "/account/totp", "{}")
+	enrollment := TOTPEnrollment{}
+	if err := json.Unmarshal(response.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal("Failed to unmarshal response: " + err.Error())
+	}
+
+	// Re-enrolling requires a valid code for the current secret
+	response = doWebServiceRequest("PUT", "/account/totp", `{"code": "000000"}`)
+	if response.Code != http.StatusForbidden {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	trigger := fmt.Sprintf("/device/%d/command/3", deviceId)
+	response = doWebServiceRequest("POST", trigger, "{}")
+	confirmation := ConfirmationResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), &confirmation); err != nil {
+		t.Fatal("Failed to unmarshal response: " + err.Error())
+	}
+
+	if !confirmation.TOTPRequired {
+		t.Errorf("Confirmation doesn't require TOTP: %#v", confirmation)
+	}
+
+	response = doWebServiceRequest("POST", confirmation.Confirm, `{"code": "abcdef"}`)
+	if response.Code != http.StatusForbidden || len(pushes) != 0 {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	code, _ := totpCode(enrollment.Secret, time.Now().Unix()/totpPeriod)
+	response = doWebServiceRequest("POST", confirmation.Confirm, `{"code": "`+code+`"}`)
+	if response.Code != http.StatusOK || len(pushes) != 1 {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// Test vector from RFC 6238, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	code, err := totpCode(secret, 59/totpPeriod)
+	if err != nil || code != "287082" {
+		t.Errorf("Unexpected TOTP code: %s", code)
+	}
+
+	if !validateTOTP(secret, "287082", time.Unix(59+totpPeriod, 0)) {
+		t.Errorf("Code from previous time step was rejected")
+	}
+
+	if validateTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0)) {
+		t.Errorf("Stale code was accepted")
+	}
+}
+
+func TestReportDeviceLocation(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	invalid := []string{
+		"latitude=abc&longitude=2.35",
+		"latitude=NaN&longitude=2.35",
+		"latitude=91&longitude=2.35",
+		"latitude=48.86&longitude=-180.5",
+		"latitude=48.86&longitude=2.35&accuracy=-1",
+		"latitude=48.86&longitude=2.35&heading=361",
+		"latitude=48.86&longitude=2.35&battery=Inf",
+		"latitude=48.86&longitude=2.35&provider=carrier-pigeon",
+		"latitude=48.86&longitude=2.35&timestamp=99999999999",
+	}
+
+	for _, params := range invalid {
+		response := doFormRequest("/device/location/1", params)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected response code for %s: %d", params, response.Code)
+		}
+	}
+
+	device, _ := gDB.GetDeviceById(1)
+	if device.Latitude != 0 || device.Timestamp != "" {
+		t.Errorf("Invalid location was stored: %#v", device)
+	}
+
+	params := "latitude=48.8606&longitude=2.3376&accuracy=5000&provider=cell&battery=42&timestamp=1370000000"
+	response := doFormRequest("/device/location/1", params)
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	device, _ = gDB.GetDeviceById(1)
+	if device.Latitude != 48.8606 || device.Accuracy == nil ||
+		*device.Accuracy != 5000 || device.Provider != "cell" ||
+		device.Battery == nil || *device.Battery != 42 ||
+		device.Timestamp != "1370000000" {
+		t.Errorf("Unexpected device location: %#v", device)
+	}
+}
+
+func TestUploadLocationBatch(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	batch := `[
+		{"latitude": 48.8606, "longitude": 2.3376, "timestamp": 1370000300},
+		{"latitude": 48.8584, "longitude": 2.2945, "timestamp": 1370000100},
+		{"latitude": 48.8606, "longitude": 2.3376, "timestamp": 1370000300}
+	]`
+
+	response := doWebServiceRequest("POST", "/device/1/locations", batch)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	result := LocationBatchResponse{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		t.Error("Failed to unmarshal response: " + err.Error())
+	}
+
+	if result.Received != 3 || result.Stored != 2 {
+		t.Errorf("Unexpected batch response: %#v", result)
+	}
+
+	device, _ := gDB.GetDeviceById(1)
+	if device.Latitude != 48.8606 || device.Timestamp != "1370000300" {
+		t.Errorf("Device doesn't have the newest location: %#v", device)
+	}
+
+	invalid := []string{
+		`[]`,
+		`[{"latitude": 48.8606, "longitude": 2.3376}]`,
+		`[{"latitude": 148.8606, "longitude": 2.3376, "timestamp": 1370000300}]`,
+	}
+
+	for _, body := range invalid {
+		response = doWebServiceRequest("POST", "/device/1/locations", body)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected response code for %s: %d", body, response.Code)
+		}
+	}
+}
+
+func TestExportTrack(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	altitude := 35.0
+	device, _ := gDB.GetDeviceById(1)
+	gDB.AddDeviceLocations(device, []Location{
+		{Latitude: 48.8606, Longitude: 2.3376, Timestamp: 1370000000},
+		{Latitude: 48.8584, Longitude: 2.2945, Altitude: &altitude, Timestamp: 1370000100},
+		{Latitude: 48.8530, Longitude: 2.3499, Timestamp: 1370000200},
+	})
+
+	response := doWebServiceRequest("GET", "/device/1/track.geojson?from=1370000100", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	collection := geoJSONFeatureCollection{}
+	if err := json.Unmarshal(response.Body.Bytes(), &collection); err != nil {
+		t.Fatal("Failed to unmarshal GeoJSON: " + err.Error())
+	}
+
+	// One line string for the track, and a point for each fix
+	if len(collection.Features) != 3 || collection.Features[0].Geometry.Type != "LineString" {
+		t.Errorf("Unexpected GeoJSON track: %s", response.Body.String())
+	}
+
+	response = doWebServiceRequest("GET", "/device/1/track.gpx?to=2000-01-01T00:00:00Z", "")
+	gpx := gpxDocument{}
+	if err := xml.Unmarshal(response.Body.Bytes(), &gpx); err != nil {
+		t.Fatal("Failed to unmarshal GPX: " + err.Error())
+	}
+
+	if len(gpx.Points) != 0 {
+		t.Errorf("Unexpected GPX track: %s", response.Body.String())
+	}
+
+	response = doWebServiceRequest("GET", "/device/1/track.gpx", "")
+	gpx = gpxDocument{}
+	if err := xml.Unmarshal(response.Body.Bytes(), &gpx); err != nil {
+		t.Fatal("Failed to unmarshal GPX: " + err.Error())
+	}
+
+	if len(gpx.Points) != 3 || *gpx.Points[1].Elevation != altitude ||
+		gpx.Points[2].Time != "2013-05-31T11:36:40Z" {
+		t.Errorf("Unexpected GPX track: %s", response.Body.String())
+	}
+
+	response = doWebServiceRequest("GET", "/device/1/track.kml", "")
+	kml := kmlDocument{}
+	if err := xml.Unmarshal(response.Body.Bytes(), &kml); err != nil {
+		t.Fatal("Failed to unmarshal KML: " + err.Error())
+	}
+
+	if len(kml.Placemarks) != 4 || kml.Placemarks[2].Point.Coordinates != "2.2945,48.8584,35" {
+		t.Errorf("Unexpected KML track: %s", response.Body.String())
+	}
+
+	response = doWebServiceRequest("GET", "/device/1/track.csv", "")
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+}
+
+func TestDeleteLocations(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	for _, id := range []int64{1, 3} {
+		device, _ := gDB.GetDeviceById(id)
+		gDB.UpdateDeviceLocation(device, Location{Latitude: 48.86, Longitude: 2.34, Timestamp: 1370000000})
+	}
+
+	response := doWebServiceRequest("DELETE", "/account/locations", "")
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	device, _ := gDB.GetDeviceById(1)
+	locations, _ := gDB.ListLocationsForDevice(device, 0, 0)
+	if len(locations) != 0 || device.Timestamp != "" {
+		t.Errorf("Locations were not deleted: %#v", device)
+	}
+
+	// Other users' devices are left alone
+	device, _ = gDB.GetDeviceById(3)
+	locations, _ = gDB.ListLocationsForDevice(device, 0, 0)
+	if len(locations) != 1 || device.Timestamp == "" {
+		t.Errorf("Another user's locations were deleted: %#v", device)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	deviceId, pushes, closeServer := addPushableDevice(t)
+	defer closeServer()
+
+	doWebServiceRequest("GET", fmt.Sprintf("/device/%d", deviceId), "")
+	doFormRequest(fmt.Sprintf("/device/location/%d", deviceId), "latitude=1&longitude=2")
+	doWebServiceRequest("POST", fmt.Sprintf("/device/%d/command/1", deviceId), "{}")
+	<-pushes
+
+	response := doNonWebServiceRequest("GET", "/metrics", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	metrics := response.Body.String()
+	expected := []string{
+		`whereismyfox_http_requests_total{code="200",method="GET",route="/device/{device-id}"}`,
+		`whereismyfox_location_reports_total{kind="single"}`,
+		`whereismyfox_push_attempts_total{transport="simplepush"}`,
+		`whereismyfox_db_query_duration_seconds_count{operation="query"}`,
+		`whereismyfox_pending_invocations 1`,
+		`whereismyfox_active_sessions 1`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Missing metric %s", line)
+		}
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var output strings.Builder
+	logger, err := newLogger(&output, "info", "json")
+	if err != nil {
+		t.Fatal("Failed to create logger: " + err.Error())
+	}
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(defaultLogger)
+
+	handler := withRequestLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "push", "device_id", 1)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	request, _ := http.NewRequest("GET", "/device/1", nil)
+	request.Header.Set("X-Request-Id", "from-proxy")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if id := response.Header().Get("X-Request-Id"); id != "from-proxy" {
+		t.Errorf("Request id was not kept: %s", id)
+	}
+
+	records := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(records) != 2 {
+		t.Fatalf("Unexpected log records: %v", records)
+	}
+
+	var event, access map[string]interface{}
+	json.Unmarshal([]byte(records[0]), &event)
+	json.Unmarshal([]byte(records[1]), &access)
+
+	if event["msg"] != "push" || event["request_id"] != "from-proxy" {
+		t.Errorf("Unexpected event record: %s", records[0])
+	}
+
+	if access["msg"] != "request" || access["request_id"] != "from-proxy" ||
+		access["status"] != float64(http.StatusTeapot) || access["path"] != "/device/1" {
+		t.Errorf("Unexpected request record: %s", records[1])
+	}
+
+	// Ids that are unsafe to log are replaced
+	request.Header.Set("X-Request-Id", "bad\nid")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	if id := response.Header().Get("X-Request-Id"); id == "" || id == "bad\nid" {
+		t.Errorf("Unexpected request id: %q", id)
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	gPersona = MockPersona{LoggedIn: false}
+
+	response := doNonWebServiceRequest("GET", "/healthz", "")
+	if response.Code != http.StatusOK {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	health := HealthResponse{}
+	response = doNonWebServiceRequest("GET", "/readyz", "")
+	json.Unmarshal(response.Body.Bytes(), &health)
+	if response.Code != http.StatusOK || health.Status != "ok" || len(health.Checks) != len(gReadinessChecks) {
+		t.Errorf("Unexpected readiness: %d %s", response.Code, response.Body.String())
+	}
+
+	gDB.connection.Exec(`delete from commands`)
+
+	health = HealthResponse{}
+	response = doNonWebServiceRequest("GET", "/readyz", "")
+	json.Unmarshal(response.Body.Bytes(), &health)
+	if response.Code != http.StatusServiceUnavailable || health.Status != "unavailable" {
+		t.Errorf("Unexpected readiness without commands: %d", response.Code)
+	}
+
+	if check := health.Checks["commands"]; check.Status != "failed" {
+		t.Errorf("Failed check was not reported: %#v", health.Checks)
+	}
+
+	if strings.Contains(response.Body.String(), "error") {
+		t.Errorf("Readiness gave away why a check failed: %s", response.Body.String())
+	}
+
+	if check := health.Checks["database"]; check.Status != "ok" {
+		t.Errorf("Unexpected database check: %#v", check)
+	}
+
+	gShuttingDown.Store(true)
+	defer gShuttingDown.Store(false)
+
+	health = HealthResponse{}
+	response = doNonWebServiceRequest("GET", "/readyz", "")
+	json.Unmarshal(response.Body.Bytes(), &health)
+	if response.Code != http.StatusServiceUnavailable || health.Checks["shutdown"].Status != "failed" {
+		t.Errorf("Unexpected readiness while shutting down: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestPushReadiness(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	keys := map[string][]byte{"a": []byte("0123456789abcdef0123456789abcdef")}
+	cipher, err := NewFieldCipher(keys, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gDB.SetCipher(cipher)
+	if _, err := gDB.AddDevice("ggp@mozilla.com", "sealed", "http://push.example.com/sealed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkPush(context.Background()); err != nil {
+		t.Errorf("Push check failed with the keys configured: %s", err)
+	}
+
+	// As after removing the key from the configuration
+	gDB.SetCipher(nil)
+	if err := checkPush(context.Background()); err == nil {
+		t.Error("Push check passed without the endpoint's key")
+	}
+}
+
+func TestAPIDocs(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	response := doNonWebServiceRequest("GET", "/apidocs.json", "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code: %d", response.Code)
+	}
+
+	doc := openAPIDocument{}
+	if err := json.Unmarshal(response.Body.Bytes(), &doc); err != nil {
+		t.Fatal("Failed to unmarshal document: " + err.Error())
+	}
+
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("Unexpected version: %s", doc.OpenAPI)
+	}
+
+	for _, name := range []string{"Device", "CommandResponse", "CommandContext", "Location", "APIErrorResponse"} {
+		if doc.Components.Schemas[name] == nil {
+			t.Errorf("Missing schema for %s", name)
+		}
+	}
+
+	if location := doc.Components.Schemas["Location"]; location != nil {
+		if latitude := location.Properties["latitude"]; latitude == nil || latitude.Type != "number" {
+			t.Errorf("Unexpected Location schema: %#v", location.Properties)
+		}
+
+		if accuracy := location.Properties["accuracy"]; accuracy == nil || !accuracy.Nullable {
+			t.Errorf("Unexpected Location schema: %#v", location.Properties)
+		}
+	}
+
+	add := doc.Paths["/device/"]["put"]
+	if add == nil || add.RequestBody == nil || len(add.Parameters) != 0 ||
+		add.RequestBody.Content["application/json"].Schema.Ref != "#/components/schemas/Device" {
+		t.Errorf("Unexpected operation for adding a device: %#v", add)
+	}
+
+	track := doc.Paths["/device/{device-id}/{track}"]["get"]
+	if track == nil || len(track.Parameters) != 4 {
+		t.Errorf("Unexpected operation for tracks: %#v", track)
+	}
+
+	trigger := doc.Paths["/device/{device-id}/command/{command-id}"]["post"]
+	if trigger == nil || trigger.Responses["202"].Content["application/json"].Schema == nil {
+		t.Errorf("Unexpected operation for triggering commands: %#v", trigger)
+	}
+
+	report := doc.Paths["/device/location/{device-id}"]["post"]
+	if report == nil || report.RequestBody == nil ||
+		len(report.RequestBody.Content["application/x-www-form-urlencoded"].Schema.Required) != 2 {
+		t.Errorf("Unexpected operation for reporting locations: %#v", report)
+	}
+
+	invocation := doc.Paths["/device/invocation/{token}"]["get"]
+	if invocation == nil || invocation.OperationId == "" {
+		t.Errorf("Unexpected operation for invocations: %#v", invocation)
+	} else if errors := invocation.Responses["default"].Content; len(errors) != 1 ||
+		errors["application/json"].Schema.Ref != "#/components/schemas/APIErrorResponse" {
+		t.Errorf("Unexpected error response for invocations: %#v", errors)
+	}
+}
+
+func TestAPIv1Errors(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	errors := []struct {
+		method, url string
+		status      int
+		code        string
+	}{
+		{"GET", "/api/v1/device/42", http.StatusNotFound, ErrDeviceNotFound},
+		{"GET", "/api/v1/device/foo", http.StatusBadRequest, ErrInvalidRequest},
+		{"GET", "/api/v1/device/1/command/7", http.StatusMethodNotAllowed, ErrMethodNotAllowed},
+		{"GET", "/api/v1/nothing", http.StatusNotFound, ErrNotFound},
+		{"POST", "/api/v1/device/1/command/42", http.StatusNotFound, ErrCommandNotFound},
+		{"GET", "/api/v1/device/?limit=0", http.StatusBadRequest, ErrInvalidRequest},
+	}
+
+	for _, e := range errors {
+		body := ""
+		if e.method == "POST" {
+			body = "{}"
+		}
+
+		response := doWebServiceRequest(e.method, e.url, body)
+		if response.Code != e.status {
+			t.Errorf("Unexpected response code for %s: %d", e.url, response.Code)
+		}
+
+		result := APIErrorResponse{}
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Errorf("Failed to unmarshal error for %s: %s", e.url, response.Body.String())
+			continue
+		}
+
+		if result.Error.Code != e.code || result.Error.Message == "" {
+			t.Errorf("Unexpected error for %s: %#v", e.url, result)
+		}
+	}
+
+	gPersona = MockPersona{LoggedIn: false}
+	response := doWebServiceRequest("GET", "/api/v1/device/", "")
+	if !strings.Contains(response.Body.String(), ErrNotLoggedIn) {
+		t.Errorf("Unexpected error: %s", response.Body.String())
+	}
+
+	// Older clients still get plain text
+	gPersona = MockPersona{LoggedIn: true}
+	response = doWebServiceRequest("GET", "/device/42", "")
+	if response.Code != http.StatusNotFound || response.Body.String() != "Device not found" {
+		t.Errorf("Unexpected legacy error: %d %s", response.Code, response.Body.String())
+	}
+
+	// ... with the status codes they were given before /api/v1
+	legacy := []struct {
+		method, url string
+		status      int
+	}{
+		{"POST", "/device/1/command/42", http.StatusBadRequest},
+		{"GET", "/device/invocation/42", http.StatusBadRequest},
+		{"GET", "/api/v1/device/invocation/42", http.StatusNotFound},
+	}
+
+	for _, e := range legacy {
+		body := ""
+		if e.method == "POST" {
+			body = "{}"
+		}
+
+		if response := doWebServiceRequest(e.method, e.url, body); response.Code != e.status {
+			t.Errorf("Unexpected response code for %s: %d", e.url, response.Code)
+		}
+	}
+
+	deviceId, _, closeServer := addPushableDevice(t)
+	closeServer()
+
+	response = doWebServiceRequest("POST", fmt.Sprintf("/device/%d/command/1", deviceId), "{}")
+	if response.Code != http.StatusInternalServerError {
+		t.Errorf("Unexpected response code for a failed legacy push: %d", response.Code)
+	}
+
+	response = doWebServiceRequest("POST", fmt.Sprintf("/api/v1/device/%d/command/1", deviceId), "{}")
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Unexpected response code for a failed push: %d", response.Code)
+	}
+}
+
+func TestAPIv1Lists(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	page := DevicePage{}
+	response := doWebServiceRequest("GET", "/api/v1/device/?limit=1&offset=1", "")
+	if err := json.Unmarshal(response.Body.Bytes(), &page); err != nil {
+		t.Fatal("Failed to unmarshal devices: " + err.Error())
+	}
+
+	if page.Total != 2 || page.Limit != 1 || page.Offset != 1 ||
+		len(page.Items) != 1 || page.Items[0].Id != 2 {
+		t.Errorf("Unexpected page of devices: %#v", page)
+	}
+
+	commands := CommandPage{}
+	response = doWebServiceRequest("GET", "/api/v1/device/1/command", "")
+	if err := json.Unmarshal(response.Body.Bytes(), &commands); err != nil {
+		t.Fatal("Failed to unmarshal commands: " + err.Error())
+	}
+
+	if commands.Total == 0 || len(commands.Items) != commands.Total ||
+		!strings.HasPrefix(commands.Items[0].Trigger, "/api/v1/device/1/command/") {
+		t.Errorf("Unexpected page of commands: %#v", commands)
+	}
+
+	response = doWebServiceRequest("PUT", "/api/v1/device/", `{"Name": "new", "Endpoint": "http://push.example.com/new"}`)
+	if response.Code != http.StatusCreated {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	device := Device{}
+	json.Unmarshal(response.Body.Bytes(), &device)
+	if location := response.Header().Get("Location"); location != fmt.Sprintf("/api/v1/device/%d", device.Id) {
+		t.Errorf("Unexpected location: %s", location)
+	}
+
+	audit := AuditPage{}
+	response = doWebServiceRequest("GET", "/api/v1/audit/?limit=1", "")
+	if err := json.Unmarshal(response.Body.Bytes(), &audit); err != nil {
+		t.Fatal("Failed to unmarshal audit log: " + err.Error())
+	}
+
+	if audit.Total != 1 || len(audit.Items) != 1 || audit.Items[0].Action != AuditDeviceAdd {
+		t.Errorf("Unexpected page of audit log: %#v", audit)
+	}
+}
+
+func TestAPIv1ErrorDetails(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	body := fmt.Sprintf(`[{"latitude": 1, "longitude": 2, "timestamp": %d},
+		{"latitude": 91, "longitude": 2, "timestamp": %d}]`, now-10, now)
+
+	response := doWebServiceRequest("POST", "/api/v1/device/1/locations", body)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	result := APIErrorResponse{}
+	json.Unmarshal(response.Body.Bytes(), &result)
+
+	details, ok := result.Error.Details.(map[string]interface{})
+	if result.Error.Code != ErrInvalidLocation || !ok || details["index"] != float64(1) {
+		t.Errorf("Unexpected error: %s", response.Body.String())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sessions are kept in the database, and the session cookie only holds a
+// random token identifying one. Only a hash of the token is stored, so
+// that the database can't be used to forge cookies. A session ends when
+// it wasn't used for the idle timeout, or at the latest once the absolute
+// timeout passed since logging in.
+
+// Last seen times are only updated this often, to spare the database a
+// write on every request.
+const sessionTouchInterval = time.Minute
+
+type Session struct {
+	Id        int64  `json:"id"`
+	User      string `json:"-"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastSeen"`
+	UserAgent string `json:"userAgent"`
+	SourceIP  string `json:"sourceIp"`
+
+	// Whether this is the session making the request
+	Current bool `json:"current"`
+}
+
+type SessionPage struct {
+	Items []Session `json:"items"`
+	Pagination
+}
+
+func newSessionToken() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// sessionExpired is true once either timeout passed. A zero timeout never
+// passes.
+func sessionExpired(session *Session, now time.Time, idle, maxAge time.Duration) bool {
+	if idle > 0 && now.Sub(time.Unix(session.LastSeen, 0)) > idle {
+		return true
+	}
+	return maxAge > 0 && now.Sub(time.Unix(session.Created, 0)) > maxAge
+}
+
+const sessionColumns = `id, user, created, last_seen, user_agent, source_ip`
+
+func (self DB) scanSession(row scanner) (*Session, error) {
+	s := Session{}
+	err := row.Scan(&s.Id, &s.User, &s.Created, &s.LastSeen, &s.UserAgent, &s.SourceIP)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (self DB) CreateSession(user, token, userAgent, sourceIP string, now time.Time) (*Session, error) {
+	res, err := self.connection.Exec(
+		`insert into sessions (token_hash, user, created, last_seen, user_agent, source_ip)
+		values (?, ?, ?, ?, ?, ?)`,
+		hashSessionToken(token), user, now.Unix(), now.Unix(), userAgent, sourceIP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{id, user, now.Unix(), now.Unix(), userAgent, sourceIP, false}, nil
+}
+
+// GetSessionByToken returns nil if no session has the token.
+func (self DB) GetSessionByToken(token string) (*Session, error) {
+	row := self.connection.QueryRow(
+		`select `+sessionColumns+` from sessions where token_hash=?`,
+		hashSessionToken(token))
+
+	session, err := self.scanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+func (self DB) TouchSession(id int64, now time.Time) error {
+	_, err := self.connection.Exec(
+		`update sessions set last_seen=? where id=?`, now.Unix(), id)
+
+	return err
+}
+
+func (self DB) ListSessions(user string) ([]Session, error) {
+	res, err := self.connection.Query(
+		`select `+sessionColumns+` from sessions where user=?
+		order by last_seen desc, id desc`, user)
+
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	sessions := []Session{}
+	for res.Next() {
+		s, err := self.scanSession(res)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *s)
+	}
+
+	return sessions, res.Err()
+}
+
+// DeleteSession ends one of the user's sessions, returning false if the
+// user has no such session.
+func (self DB) DeleteSession(user string, id int64) (bool, error) {
+	res, err := self.connection.Exec(
+		`delete from sessions where user=? and id=?`, user, id)
+
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	return deleted != 0, err
+}
+
+// DeleteOtherSessions ends all of the user's sessions but one.
+func (self DB) DeleteOtherSessions(user string, keep int64) (int64, error) {
+	res, err := self.connection.Exec(
+		`delete from sessions where user=? and id!=?`, user, keep)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// PruneSessions deletes sessions idle since before idleBefore, or created
+// before createdBefore.
+func (self DB) PruneSessions(idleBefore, createdBefore int64) (int64, error) {
+	res, err := self.connection.Exec(
+		`delete from sessions where last_seen<? or created<?`,
+		idleBefore, createdBefore)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func pruneSessions(db *DB, now time.Time) error {
+	idle := time.Duration(gServerConfig.SessionIdleHours) * time.Hour
+	maxAge := time.Duration(gServerConfig.SessionMaxAgeHours) * time.Hour
+
+	idleBefore, createdBefore := int64(0), int64(0)
+	if idle > 0 {
+		idleBefore = now.Add(-idle).Unix()
+	}
+	if maxAge > 0 {
+		createdBefore = now.Add(-maxAge).Unix()
+	}
+
+	_, err := db.PruneSessions(idleBefore, createdBefore)
+	return err
+}
+
+func serveSessions(request *restful.Request, response *restful.Response) {
+	page, err := parsePagination(request)
+	if err != nil && isVersionedAPI(request) {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	sessions, err := gDB.ListSessions(gPersona.GetLoginName(request.Request))
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve sessions")
+		return
+	}
+
+	current := gPersona.GetSessionId(request.Request)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == current
+	}
+
+	if isVersionedAPI(request) {
+		start, end := page.bounds(len(sessions))
+		response.WriteEntity(SessionPage{sessions[start:end], page})
+		return
+	}
+
+	response.WriteEntity(sessions)
+}
+
+func revokeSession(request *restful.Request, response *restful.Response) {
+	id, err := strconv.ParseInt(request.PathParameter("session-id"), 10, 64)
+	if err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse session")
+		return
+	}
+
+	arguments := map[string]int64{"session": id}
+	deleted, err := gDB.DeleteSession(gPersona.GetLoginName(request.Request), id)
+	if err != nil {
+		audit(request, 0, AuditSessionRevoke, "", arguments, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to revoke session")
+		return
+	}
+
+	if !deleted {
+		writeError(request, response, http.StatusNotFound, ErrSessionNotFound, "Session not found")
+		return
+	}
+
+	audit(request, 0, AuditSessionRevoke, "", arguments, "ok")
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOtherSessions logs out everywhere but from the session making the
+// request.
+func revokeOtherSessions(request *restful.Request, response *restful.Response) {
+	user := gPersona.GetLoginName(request.Request)
+	revoked, err := gDB.DeleteOtherSessions(user, gPersona.GetSessionId(request.Request))
+	if err != nil {
+		audit(request, 0, AuditSessionRevoke, "", nil, "failed")
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to revoke sessions")
+		return
+	}
+
+	audit(request, 0, AuditSessionRevoke, "", map[string]int64{"revoked": revoked}, "ok")
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,192 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "testing"
+import "time"
+
+func testSessionConfig(key string) ServerConfig {
+	config := defaultConfig()
+	config.SessionCookie = key
+	return config
+}
+
+func loginWithTestVerifier(t *testing.T, persona PersonaHandler, email string) *http.Cookie {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(PersonaResponse{Status: "okay", Email: email})
+	}))
+	defer verifier.Close()
+
+	form := url.Values{"assertion": {"assertion"}}
+	request, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("User-Agent", "test-agent")
+
+	response := httptest.NewRecorder()
+	if err := persona.Login(verifier.URL, response, request); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Unexpected cookies: %v", cookies)
+	}
+	return cookies[0]
+}
+
+func requestWithCookie(cookie *http.Cookie) *http.Request {
+	request, _ := http.NewRequest("GET", "/device", nil)
+	request.AddCookie(cookie)
+	return request
+}
+
+func TestServerSideSessions(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+	gDB = db
+	defer func() { gDB = nil }()
+
+	persona := NewPersonaHandler(testSessionConfig("s3cr3t"))
+	cookie := loginWithTestVerifier(t, persona, "ggp@mozilla.com")
+
+	if !persona.IsLoggedIn(requestWithCookie(cookie)) || persona.GetLoginName(requestWithCookie(cookie)) != "ggp@mozilla.com" {
+		t.Fatal("Session wasn't recognized")
+	}
+
+	sessions, err := db.ListSessions("ggp@mozilla.com")
+	if err != nil || len(sessions) != 1 || sessions[0].UserAgent != "test-agent" {
+		t.Fatalf("Unexpected sessions: %#v, %v", sessions, err)
+	}
+
+	if id := persona.GetSessionId(requestWithCookie(cookie)); id != sessions[0].Id {
+		t.Errorf("Unexpected session id: %d", id)
+	}
+
+	// Revoking the session logs the cookie out
+	if deleted, _ := db.DeleteSession("ggp@mozilla.com", sessions[0].Id); !deleted {
+		t.Fatal("Session wasn't deleted")
+	}
+
+	if persona.IsLoggedIn(requestWithCookie(cookie)) {
+		t.Error("Revoked session is still logged in")
+	}
+
+	cookie = loginWithTestVerifier(t, persona, "ggp@mozilla.com")
+	response := httptest.NewRecorder()
+	persona.Logout(response, requestWithCookie(cookie))
+
+	if persona.IsLoggedIn(requestWithCookie(cookie)) {
+		t.Error("Session is still logged in after logging out")
+	}
+
+	if sessions, _ := db.ListSessions("ggp@mozilla.com"); len(sessions) != 0 {
+		t.Errorf("Sessions left after logging out: %#v", sessions)
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	now := time.Now()
+	session := &Session{Created: now.Add(-10 * time.Hour).Unix(), LastSeen: now.Add(-2 * time.Hour).Unix()}
+
+	if sessionExpired(session, now, 3*time.Hour, 24*time.Hour) {
+		t.Error("Session expired early")
+	}
+
+	if !sessionExpired(session, now, time.Hour, 24*time.Hour) {
+		t.Error("Idle session didn't expire")
+	}
+
+	if !sessionExpired(session, now, 3*time.Hour, 5*time.Hour) {
+		t.Error("Old session didn't expire")
+	}
+
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+
+	db.CreateSession("ggp@mozilla.com", "old", "", "", now.Add(-40*24*time.Hour))
+	db.CreateSession("ggp@mozilla.com", "new", "", "", now)
+
+	gServerConfig = defaultConfig()
+	defer func() { gServerConfig = ServerConfig{} }()
+
+	if err := pruneSessions(db, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if old, _ := db.GetSessionByToken("old"); old != nil {
+		t.Error("Expired session wasn't pruned")
+	}
+
+	if current, _ := db.GetSessionByToken("new"); current == nil {
+		t.Error("Current session was pruned")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	db, cleanup := initTestDatabase(t)
+	defer cleanup()
+	gDB = db
+	defer func() { gDB = nil }()
+
+	cookie := loginWithTestVerifier(t, NewPersonaHandler(testSessionConfig("old-key")), "ggp@mozilla.com")
+
+	if NewPersonaHandler(testSessionConfig("new-key")).IsLoggedIn(requestWithCookie(cookie)) {
+		t.Error("Cookie signed with an unknown key was accepted")
+	}
+
+	config := testSessionConfig("new-key")
+	config.SessionCookieOldKeys = []string{"old-key"}
+	if !NewPersonaHandler(config).IsLoggedIn(requestWithCookie(cookie)) {
+		t.Error("Cookie signed with an old key was refused")
+	}
+}
+
+func TestSessionsAPI(t *testing.T) {
+	cleanup := initTestingServer(t)
+	defer cleanup()
+
+	now := time.Now()
+	first, _ := gDB.CreateSession("ggp@mozilla.com", "first", "phone", "10.0.0.1", now)
+	gDB.CreateSession("ggp@mozilla.com", "second", "laptop", "10.0.0.2", now)
+	other, _ := gDB.CreateSession("other@mozilla.com", "other", "", "", now)
+
+	page := SessionPage{}
+	response := doWebServiceRequest("GET", "/api/v1/account/sessions", "")
+	if err := json.Unmarshal(response.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+
+	if page.Total != 2 || len(page.Items) != 2 {
+		t.Errorf("Unexpected sessions: %#v", page)
+	}
+
+	response = doWebServiceRequest("DELETE", fmt.Sprintf("/api/v1/account/sessions/%d", other.Id), "")
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Revoked another user's session: %d", response.Code)
+	}
+
+	response = doWebServiceRequest("DELETE", fmt.Sprintf("/api/v1/account/sessions/%d", first.Id), "")
+	if response.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	if session, _ := gDB.GetSessionByToken("first"); session != nil {
+		t.Error("Session wasn't revoked")
+	}
+
+	if response := doWebServiceRequest("DELETE", "/api/v1/account/sessions", ""); response.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code: %d", response.Code)
+	}
+
+	if sessions, _ := gDB.ListSessions("ggp@mozilla.com"); len(sessions) != 0 {
+		t.Errorf("Sessions weren't revoked: %#v", sessions)
+	}
+
+	if session, _ := gDB.GetSessionByToken("other"); session == nil {
+		t.Error("Another user's session was revoked")
+	}
+}
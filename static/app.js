@@ -2,11 +2,51 @@ var personaArguments = {
     siteName: 'Where Is My Fox?',
 };
 
+/*
+ * Requests changing anything must carry the CSRF token of the session,
+ * which changes when logging in and out.
+ */
+var csrfToken = null;
+
+function fetchCSRFToken() {
+    return $.getJSON('/auth/csrf').then(function(res) {
+        csrfToken = res.csrfToken;
+    });
+}
+
+$.ajaxPrefilter(function(options, originalOptions, xhr) {
+    if (!/^(GET|HEAD|OPTIONS)$/i.test(options.type) && csrfToken) {
+        xhr.setRequestHeader('X-CSRF-Token', csrfToken);
+    }
+});
+
+/*
+ * Fixes from cell towers can be kilometers off, so don't present them as
+ * precisely as GPS fixes.
+ */
+function locationPrecision(device) {
+    if (device.accuracy === undefined) {
+        return "unknown";
+    } else if (device.accuracy <= 100) {
+        return "precise";
+    } else if (device.accuracy <= 1000) {
+        return "approximate";
+    }
+    return "imprecise";
+}
+
 function renderDeviceTable(devices) {
     if (devices.length) {
         devices[0].first = true;
     }
 
+    devices.forEach(function(device) {
+        device.precision = locationPrecision(device);
+        if (device.accuracy !== undefined) {
+            device.accuracyText = Math.round(device.accuracy) + " m";
+        }
+    });
+
     var table = Mustache.render($('#device-list-template').html(), {
         devices: devices,
         mapsURL: "https://maps.google.com/maps?q="
@@ -16,30 +56,42 @@ function renderDeviceTable(devices) {
 }
 
 /*
- * Takes an array of jQuery XHR requests, and returns a Promise that resolves
- * when all of then succeed and rejects when any of them fails. The Promise
- * resolves to an array, each element being the result of each request in the
- * order they were passed.
+ * Takes an array of Promises each resolving to a single value, such as those
+ * returned by getAllPages(), and returns a Promise that resolves when all of
+ * then succeed and rejects when any of them fails. The Promise resolves to an
+ * array, each element being the result of each request in the order they were
+ * passed.
  *
- * NOTE: jQuery.when() when called with just one promise (e.g. in the case
- * where the user has only one device registered), passes the result of that
- * promise to the associated callback, while for multiple devices, it passes
- * a list.  This is stupid behaviour for our case.
+ * NOTE: jQuery.when() passes each result as a separate argument, and nothing
+ * at all when there are no promises (e.g. when the user has no devices).
  *
  */
 function URLs_every(deferreds) {
     return $.when.apply(null, deferreds).then(function() {
-        if (deferreds.length == 1) {
-            // In the single promise case, this function is passed three
-            // arguments similar to jqXHR.done(), of which the first is the
-            // response.
-            return [arguments[0]];
-        } else {
-            return Array.prototype.slice.call(arguments).map(function(jqXHRResult) { return jqXHRResult[0]; });
-        }
+        return Array.prototype.slice.call(arguments);
     });
 }
 
+/*
+ * Fetches every item of a paged list, following the pages until the total is
+ * reached. Returns a Promise resolving to the items.
+ */
+function getAllPages(url) {
+    var items = [];
+
+    function getPage(offset) {
+        return $.getJSON(url, {limit: 500, offset: offset}).then(function(page) {
+            items = items.concat(page.items);
+            if (page.items.length == 0 || page.offset + page.limit >= page.total) {
+                return items;
+            }
+            return getPage(page.offset + page.limit);
+        });
+    }
+
+    return getPage(0);
+}
+
 function updateDevices() {
     $("#devices").html("Fetching list...");
 
@@ -47,24 +99,16 @@ function updateDevices() {
         $("#devices").html("Failed to fetch your devices!");
     }
 
-    $.getJSON('/device').then(function(list) {
-        var deviceRequests = list.map(function(url) {
-            return $.getJSON(url);
+    getAllPages('/api/v1/device').then(function(devices) {
+        var commandRequests = devices.map(function(device) {
+            return getAllPages('/api/v1/device/' + device.id + '/command');
         });
 
-        URLs_every(deviceRequests).then(function(devices) {
-            var commandRequests = devices.map(function(device) {
-                return $.getJSON('/device/' + device.Id + '/command');
-            });
-
-            URLs_every(commandRequests).then(function(commands) {
-                for (var i = 0; i < devices.length; i++) {
-                    devices[i].commands = commands[i];
-                }
-                console.log(devices);
-                renderDeviceTable(devices);
-            });
-
+        URLs_every(commandRequests).then(function(commands) {
+            for (var i = 0; i < devices.length; i++) {
+                devices[i].commands = commands[i];
+            }
+            renderDeviceTable(devices);
         }, failedToFetchDevices);
     }, failedToFetchDevices);
 }
@@ -72,11 +116,19 @@ function updateDevices() {
 $("document").ready(function(){
 
     $("#persona-logout").hide();
+    $("#pair-device").hide();
+    $("#delete-locations").hide();
+    $("#export-account").hide();
+    $("#delete-account").hide();
     $("#devices").hide();
 
     function loggedIn(){
         $("#persona-login").hide();
         $("#persona-logout").show();
+        $("#pair-device").show();
+        $("#delete-locations").show();
+        $("#export-account").show();
+        $("#delete-account").show();
 
         $("#devices").show();
         updateDevices();
@@ -84,9 +136,13 @@ $("document").ready(function(){
 
     function loggedOut(){
         $("#persona-logout").hide();
+        $("#pair-device").hide();
+        $("#delete-locations").hide();
+        $("#export-account").hide();
+        $("#delete-account").hide();
         $("#persona-login").show();
         $("#devices").hide();
-        $.get('/auth/logout');
+        $.post('/auth/logout').always(fetchCSRFToken);
     }
 
     $("#persona-login").on("click", function(e) {
@@ -99,12 +155,86 @@ $("document").ready(function(){
         navigator.id.logout();
     });
 
+    $("#pair-device").on("click", function(e) {
+        e.preventDefault();
+        $.ajax({
+            type: 'POST',
+            url: '/api/v1/pairing',
+            contentType: 'application/json',
+            data: '{}'
+        }).then(function(pairing) {
+            alert("Enter " + pairing.code + " on your device within 10 minutes, or scan:\n" + pairing.payload);
+        });
+    });
+
+    $("#delete-locations").on("click", function(e) {
+        e.preventDefault();
+        if (!window.confirm("Delete the location history of all your devices?")) {
+            return;
+        }
+
+        $.ajax({type: 'DELETE', url: '/api/v1/account/locations'}).then(updateDevices);
+    });
+
+    // Exports are always requested in the background, then downloaded
+    // once ready.
+    function waitForExport(job) {
+        if (job.status == "ready") {
+            window.location = job.download;
+        } else if (job.status == "pending") {
+            setTimeout(function() {
+                $.getJSON('/api/v1/account/export/' + job.id).then(waitForExport);
+            }, 2000);
+        } else {
+            alert("The export failed");
+        }
+    }
+
+    $("#export-account").on("click", function(e) {
+        e.preventDefault();
+        $.ajax({
+            type: 'POST',
+            url: '/api/v1/account/export?async=true',
+            contentType: 'application/json',
+            data: '{}'
+        }).then(waitForExport);
+    });
+
+    $("#delete-account").on("click", function(e) {
+        e.preventDefault();
+        if (!window.confirm("Delete your account, with all your devices and their location history? This can't be undone.")) {
+            return;
+        }
+
+        $.ajax({type: 'DELETE', url: '/api/v1/account'}).then(function(confirmation) {
+            var code = "";
+            if (confirmation.totpRequired) {
+                code = window.prompt("Enter the code from your authenticator app");
+                if (code === null) {
+                    return;
+                }
+            }
+
+            $.ajax({
+                type: 'POST',
+                url: confirmation.confirm,
+                contentType: 'application/json',
+                data: JSON.stringify({code: code})
+            }).then(function() {
+                navigator.id.logout();
+            }, function(xhr) {
+                alert("Failed to delete the account: " + xhr.responseJSON.error.message);
+            });
+        });
+    });
+
     function mailVerified(assertion){
         $.ajax({
             type: 'POST',
             url: '/auth/login',
             data: {assertion: assertion},
             success: function(res, status, xhr) {
+                csrfToken = res.csrfToken;
                 loggedIn();
             },
             error: function(xhr, status, err) {
@@ -113,9 +243,11 @@ $("document").ready(function(){
         });
     }
 
-    navigator.id.watch({
-      onlogin: mailVerified,
-      onlogout: loggedOut
+    fetchCSRFToken().then(function() {
+        navigator.id.watch({
+          onlogin: mailVerified,
+          onlogout: loggedOut
+        });
     });
 
     // Use jQuery's delegation capability to monitor all button clicks, even in
@@ -124,7 +256,43 @@ $("document").ready(function(){
         var select = $(this).parent().prev().children("select"),
             option = select.children("option:selected");
 
-        $.post(option.data("trigger"));
+        $.ajax({
+            type: 'POST',
+            url: option.data("trigger"),
+            contentType: 'application/json',
+            data: '{}'
+        }).done(function(res, status, xhr) {
+            // Destructive commands need to be confirmed before being sent
+            if (xhr.status == 202) {
+                confirmCommand(option.text(), res);
+            }
+        });
     });
 });
 
+function confirmCommand(name, confirmation) {
+    if (!window.confirm('Really "' + name + '"? This cannot be undone.')) {
+        return;
+    }
+
+    var body = {};
+    if (confirmation.totpRequired) {
+        var code = window.prompt("Enter the code from your authenticator app");
+        if (code === null) {
+            return;
+        }
+        body.code = code;
+    }
+
+    $.ajax({
+        type: 'POST',
+        url: confirmation.confirm,
+        contentType: 'application/json',
+        data: JSON.stringify(body),
+        error: function(xhr, status, err) {
+            var error = xhr.responseJSON ? xhr.responseJSON.error.message : xhr.responseText;
+            alert("Failed to confirm command: " + error);
+        }
+    });
+}
+
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes, at most.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a certificate read from files, and reads them again
+// when they change, so that renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (self *certReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{self.certFile, self.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reads the files again if they changed since they were last read.
+// Must be called with the lock held, or before the reloader is shared.
+func (self *certReloader) reload(now time.Time) error {
+	self.lastCheck = now
+
+	modTime, err := self.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	if self.cert != nil && modTime.Equal(self.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(self.certFile, self.keyFile)
+	if err != nil {
+		return err
+	}
+
+	self.cert = &cert
+	self.modTime = modTime
+	return nil
+}
+
+// GetCertificate keeps serving the previous certificate if the files
+// can't be read, e.g. while they are being replaced.
+func (self *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(self.lastCheck) >= certReloadInterval {
+		if err := self.reload(now); err != nil {
+			slog.Error("Failed to reload certificate", "file", self.certFile, "error", err)
+		}
+	}
+
+	return self.cert, nil
+}
+
+func newACMEManager(config ServerConfig) *autocert.Manager {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomains...),
+		Email:      config.ACMEEmail,
+	}
+
+	if config.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.ACMEDirectoryURL}
+	}
+
+	return manager
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL on the
+// TLS port.
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		url := *r.URL
+		url.Scheme = "https"
+		url.Host = host
+		http.Redirect(w, r, url.String(), http.StatusMovedPermanently)
+	})
+}
+
+// tlsConfig returns the TLS configuration for the server, along with the
+// handler for the plain HTTP listener. With ACME the plain HTTP listener
+// also answers http-01 challenges.
+func tlsConfig(config ServerConfig) (*tls.Config, http.Handler, error) {
+	redirect := httpsRedirectHandler(config.Port)
+
+	if len(config.ACMEDomains) != 0 {
+		manager := newACMEManager(config)
+		return manager.TLSConfig(), manager.HTTPHandler(redirect), nil
+	}
+
+	reloader, err := newCertReloader(config.CertFilename, config.KeyFilename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load certificate: %s", err)
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, redirect, nil
+}
+
+// isLoopback is true for hostnames only reachable from this machine,
+// where serving plain HTTP is acceptable.
+func isLoopback(hostname string) bool {
+	if hostname == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,128 @@
+package main
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func writeTestCertificate(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certificateName(t *testing.T, reloader *certReloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal("Failed to get certificate: " + err.Error())
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whereismyfoxtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal("Failed to load certificate: " + err.Error())
+	}
+
+	if name := certificateName(t, reloader); name != "first" {
+		t.Errorf("Unexpected certificate: %s", name)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	// Not checked again until certReloadInterval has passed
+	if name := certificateName(t, reloader); name != "first" {
+		t.Errorf("Certificate was reloaded too early: %s", name)
+	}
+
+	reloader.lastCheck = time.Time{}
+	if name := certificateName(t, reloader); name != "second" {
+		t.Errorf("Certificate was not reloaded: %s", name)
+	}
+
+	// A broken certificate keeps the previous one in use
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	reloader.lastCheck = time.Time{}
+	if name := certificateName(t, reloader); name != "second" {
+		t.Errorf("Unexpected certificate after failed reload: %s", name)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	redirects := map[string]string{
+		"443":  "https://example.com/device/1?foo=bar",
+		"8443": "https://example.com:8443/device/1?foo=bar",
+	}
+
+	for port, expected := range redirects {
+		request, _ := http.NewRequest("GET", "http://example.com:8080/device/1?foo=bar", nil)
+		response := httptest.NewRecorder()
+		httpsRedirectHandler(port).ServeHTTP(response, request)
+
+		if response.Code != http.StatusMovedPermanently {
+			t.Errorf("Unexpected response code: %d", response.Code)
+		}
+
+		if location := response.Header().Get("Location"); location != expected {
+			t.Errorf("Unexpected redirect: %s", location)
+		}
+	}
+}
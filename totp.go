@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Time-based one-time passwords as described in RFC 6238, using the
+// parameters every authenticator app understands: HMAC-SHA1, 30 second
+// steps and 6 digits.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpIssuer = "WhereIsMyFox"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validateTOTP accepts codes from the current time step and the ones
+// immediately before and after it, to allow for some clock drift.
+func validateTOTP(secret, code string, now time.Time) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	counter := now.Unix() / totpPeriod
+	for _, c := range []int64{counter - 1, counter, counter + 1} {
+		expected, err := totpCode(secret, c)
+		if err != nil {
+			return false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func totpURI(secret, account string) string {
+	label := url.PathEscape(totpIssuer + ":" + account)
+	params := url.Values{
+		"secret": {secret},
+		"issuer": {totpIssuer},
+		"digits": {fmt.Sprint(totpDigits)},
+		"period": {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func (self DB) SetTOTPSecret(user, secret string) error {
+	_, err := self.connection.Exec(
+		`insert or replace into totp_secrets(user, secret) values(?, ?)`,
+		user, secret)
+
+	return err
+}
+
+// GetTOTPSecret returns an empty secret if the user hasn't enrolled.
+func (self DB) GetTOTPSecret(user string) (string, error) {
+	var secret string
+	err := self.connection.QueryRow(
+		`select secret from totp_secrets where user=?`, user).Scan(&secret)
+
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return secret, err
+}
+
+func (self DB) DeleteTOTPSecret(user string) error {
+	_, err := self.connection.Exec(
+		`delete from totp_secrets where user=?`, user)
+
+	return err
+}
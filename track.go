@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/emicklei/go-restful"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exports of a device's location history in formats understood by
+// mapping and GIS tools.
+
+type trackWriter func(w io.Writer, device *Device, locations []Location) error
+
+type trackFormat struct {
+	contentType string
+	write       trackWriter
+}
+
+var gTrackFormats = map[string]trackFormat{
+	"geojson": {"application/geo+json", writeGeoJSONTrack},
+	"gpx":     {"application/gpx+xml", writeGPXTrack},
+	"kml":     {"application/vnd.google-earth.kml+xml", writeKMLTrack},
+}
+
+func isoTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// parseTimeParam accepts either seconds since the epoch or an RFC 3339
+// date. An empty string means no bound.
+func parseTimeParam(str string) (int64, error) {
+	if str == "" {
+		return 0, nil
+	}
+
+	if timestamp, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return timestamp, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Unix(), nil
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// GeoJSON positions are longitude first, with an optional altitude.
+func geoJSONPosition(l Location) []float64 {
+	if l.Altitude != nil {
+		return []float64{l.Longitude, l.Latitude, *l.Altitude}
+	}
+	return []float64{l.Longitude, l.Latitude}
+}
+
+func writeGeoJSONTrack(w io.Writer, device *Device, locations []Location) error {
+	collection := geoJSONFeatureCollection{"FeatureCollection", []geoJSONFeature{}}
+
+	line := make([][]float64, len(locations))
+	for i, l := range locations {
+		line[i] = geoJSONPosition(l)
+	}
+
+	if len(locations) > 1 {
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: geoJSONGeometry{"LineString", line},
+			Properties: map[string]interface{}{
+				"device": device.Name,
+				"start":  isoTime(locations[0].Timestamp),
+				"end":    isoTime(locations[len(locations)-1].Timestamp),
+			},
+		})
+	}
+
+	for i, l := range locations {
+		properties := map[string]interface{}{
+			"device": device.Name,
+			"time":   isoTime(l.Timestamp),
+		}
+
+		optional := map[string]*float64{
+			"accuracy": l.Accuracy,
+			"speed":    l.Speed,
+			"heading":  l.Heading,
+			"battery":  l.Battery,
+		}
+
+		for name, value := range optional {
+			if value != nil {
+				properties[name] = *value
+			}
+		}
+
+		if l.Provider != "" {
+			properties["provider"] = l.Provider
+		}
+
+		if l.Address != "" {
+			properties["address"] = l.Address
+		}
+
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{"Point", line[i]},
+			Properties: properties,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(collection)
+}
+
+type gpxPoint struct {
+	Latitude  float64  `xml:"lat,attr"`
+	Longitude float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele,omitempty"`
+	Time      string   `xml:"time"`
+	Source    string   `xml:"src,omitempty"`
+}
+
+type gpxDocument struct {
+	XMLName xml.Name   `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	Name    string     `xml:"trk>name"`
+	Points  []gpxPoint `xml:"trk>trkseg>trkpt"`
+}
+
+func writeGPXTrack(w io.Writer, device *Device, locations []Location) error {
+	doc := gpxDocument{Version: "1.1", Creator: "WhereIsMyFox", Name: device.Name}
+
+	for _, l := range locations {
+		doc.Points = append(doc.Points, gpxPoint{
+			Latitude:  l.Latitude,
+			Longitude: l.Longitude,
+			Elevation: l.Altitude,
+			Time:      isoTime(l.Timestamp),
+			Source:    l.Provider,
+		})
+	}
+
+	return writeXML(w, doc)
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlLineString struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPlacemark struct {
+	Name        string         `xml:"name,omitempty"`
+	Description string         `xml:"description,omitempty"`
+	When        string         `xml:"TimeStamp>when,omitempty"`
+	Point       *kmlPoint      `xml:"Point,omitempty"`
+	LineString  *kmlLineString `xml:"LineString,omitempty"`
+}
+
+type kmlDocument struct {
+	XMLName    xml.Name       `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+func kmlCoordinates(l Location) string {
+	if l.Altitude != nil {
+		return fmt.Sprintf("%v,%v,%v", l.Longitude, l.Latitude, *l.Altitude)
+	}
+	return fmt.Sprintf("%v,%v", l.Longitude, l.Latitude)
+}
+
+func writeKMLTrack(w io.Writer, device *Device, locations []Location) error {
+	doc := kmlDocument{Name: device.Name}
+
+	if len(locations) > 1 {
+		coordinates := make([]string, len(locations))
+		for i, l := range locations {
+			coordinates[i] = kmlCoordinates(l)
+		}
+
+		doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+			Name:       device.Name,
+			LineString: &kmlLineString{strings.Join(coordinates, " ")},
+		})
+	}
+
+	for _, l := range locations {
+		description := ""
+		if l.Accuracy != nil {
+			description = fmt.Sprintf("Accuracy: %v m", *l.Accuracy)
+		}
+
+		doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+			Name:        isoTime(l.Timestamp),
+			Description: description,
+			When:        isoTime(l.Timestamp),
+			Point:       &kmlPoint{kmlCoordinates(l)},
+		})
+	}
+
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
+
+func serveDeviceTrack(request *restful.Request, response *restful.Response) {
+	device := getDeviceForRequest(request, response)
+	if device == nil {
+		return
+	}
+
+	extension := strings.TrimPrefix(request.PathParameter("track"), "track.")
+	format, exists := gTrackFormats[extension]
+	if !exists {
+		writeError(request, response, http.StatusNotFound, ErrNotFound, "Unknown track format")
+		return
+	}
+
+	from, err := parseTimeParam(request.QueryParameter("from"))
+	if err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse from")
+		return
+	}
+
+	to, err := parseTimeParam(request.QueryParameter("to"))
+	if err != nil {
+		writeError(request, response, http.StatusBadRequest, ErrInvalidRequest, "Failed to parse to")
+		return
+	}
+
+	locations, err := gDB.ListLocationsForDevice(device, from, to)
+	if err != nil {
+		writeError(request, response, http.StatusInternalServerError, ErrInternal, "Failed to retrieve locations")
+		return
+	}
+
+	response.AddHeader("Content-Type", format.contentType)
+	response.AddHeader("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="device-%d.%s"`, device.Id, extension))
+	format.write(response, device, locations)
+}